@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// viewerLimits are the maximum numbers of WebRTC viewers, zero means unlimited.
+type viewerLimits struct {
+	total int
+	perIP int
+}
+
+var (
+	admissionMutex sync.Mutex
+	limits         viewerLimits
+	totalViewers   int
+	viewersPerIP   = map[string]int{}
+)
+
+// admitViewer counts a new viewer of s coming from r, unless a limit is reached.
+// It returns the function to call when the viewer leaves or, when it is rejected, the reason.
+func admitViewer(s *liveStream, r *http.Request) (func(), string) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	admissionMutex.Lock()
+	defer admissionMutex.Unlock()
+
+	if n, _ := s.viewerCount(); s.conf.MaxViewers != 0 && n >= s.conf.MaxViewers {
+		return nil, fmt.Sprintf("stream '%s' reached its maximum of %d viewers", s.name, s.conf.MaxViewers)
+	}
+	if limits.total != 0 && totalViewers >= limits.total {
+		return nil, fmt.Sprintf("the server reached its maximum of %d viewers", limits.total)
+	}
+	if limits.perIP != 0 && viewersPerIP[ip] >= limits.perIP {
+		return nil, fmt.Sprintf("maximum of %d connections per address reached", limits.perIP)
+	}
+
+	totalViewers++
+	viewersPerIP[ip]++
+	s.addViewer(1)
+
+	return func() {
+		admissionMutex.Lock()
+		defer admissionMutex.Unlock()
+
+		totalViewers--
+		viewersPerIP[ip]--
+		if viewersPerIP[ip] == 0 {
+			delete(viewersPerIP, ip)
+		}
+		s.addViewer(-1)
+	}, ""
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4/seekablebuffer"
+	"github.com/nicksanford/rtspwebrtcbridge/clip"
+	"github.com/nicksanford/rtspwebrtcbridge/dvr"
+	"gopkg.in/yaml.v3"
+)
+
+type clipRequest struct {
+	// RFC3339 wall-clock times or durations relative to now, e.g. "-30s"
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type clipResponse struct {
+	URL   string    `json:"url"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// serveStreamAPI handles /api/streams and /api/streams/{name}/...
+func serveStreamAPI(w http.ResponseWriter, r *http.Request) {
+	// creating and deleting streams are admin actions,
+	// the other endpoints can be used by the pages of allowed origins
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/streams"), "/")
+	if (path == "" && r.Method == http.MethodPost) ||
+		(path != "" && !strings.Contains(path, "/") && r.Method == http.MethodDelete) {
+		withAdminAuth(routeStreamAPI)(w, r)
+		return
+	}
+	withCORS(routeStreamAPI)(w, r)
+}
+
+// routeStreamAPI routes the requests of serveStreamAPI.
+func routeStreamAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/streams"), "/")
+	if path == "" {
+		serveStreams(w, r)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) == 1 {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := deleteStream(parts[0])
+		switch {
+		case errors.Is(err, errStreamNotFound):
+			http.Error(w, fmt.Sprintf("stream '%s' not found", parts[0]), http.StatusNotFound)
+			return
+		case errors.Is(err, errDefaultStream):
+			http.Error(w, fmt.Sprintf("stream '%s' is the default stream and can't be deleted", parts[0]), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the video and the viewers of the stream are available to its viewers only
+	if parts[1] == "clips" || parts[1] == "snapshot" || parts[1] == "stats" {
+		if _, ok := authorizeViewer(w, r, parts[0]); !ok {
+			return
+		}
+	}
+
+	s := findStream(parts[0])
+	if s == nil {
+		http.Error(w, fmt.Sprintf("stream '%s' not found", parts[0]), http.StatusNotFound)
+		return
+	}
+
+	switch parts[1] {
+	case "clips":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		serveClip(w, r, s)
+
+	case "snapshot":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		serveSnapshot(w, r, s)
+
+	case "stats":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		serveStats(w, s)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type streamInfo struct {
+	Name          string   `json:"name"`
+	Codec         string   `json:"codec"`
+	Source        string   `json:"source,omitempty"`
+	BackupSources []string `json:"backupSources,omitempty"`
+	SubSource     string   `json:"subSource,omitempty"`
+	Outputs       []string `json:"outputs,omitempty"`
+}
+
+// serveStreams lists the streams on GET and creates one on POST,
+// the body has the fields of the streams of the configuration file.
+func serveStreams(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list := []*streamInfo{}
+		for _, sc := range listStreams() {
+			info := &streamInfo{
+				Name:    sc.Name,
+				Codec:   sc.Codec,
+				Outputs: sc.Outputs,
+			}
+			if sc.Source != "" {
+				urls := sc.sourceConf().urls
+				info.Source = redactURL(urls[0])
+				for _, u := range urls[1:] {
+					info.BackupSources = append(info.BackupSources, redactURL(u))
+				}
+			}
+			if sc.SubSource != "" {
+				info.SubSource = redactURL(sc.subStreamConf().sourceConf().urls[0])
+			}
+			list = append(list, info)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list) //nolint:errcheck
+
+	case http.MethodPost:
+		// JSON is YAML, which handles durations like "10s"
+		var sc streamConf
+		dec := yaml.NewDecoder(r.Body)
+		dec.KnownFields(true)
+		if err := dec.Decode(&sc); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := createStream(&sc)
+		switch {
+		case errors.Is(err, errStreamExists):
+			http.Error(w, fmt.Sprintf("stream '%s' already exists", sc.Name), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Location", "/api/streams/"+sc.Name)
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func serveClip(w http.ResponseWriter, r *http.Request, s *liveStream) {
+	var req clipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	start, err := parseClipTime(req.Start, now)
+	if err != nil {
+		http.Error(w, "invalid start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	end := now
+	if req.End != "" {
+		end, err = parseClipTime(req.End, now)
+		if err != nil {
+			http.Error(w, "invalid end: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !end.After(start) {
+		http.Error(w, "end must be after start", http.StatusBadRequest)
+		return
+	}
+
+	entries := s.dvr.Range(start, end)
+	if len(entries) == 0 {
+		http.Error(w, "requested range is not in the buffer", http.StatusNotFound)
+		return
+	}
+
+	fileName := fmt.Sprintf("%s_%s_%s.mp4", s.name,
+		entries[0].NTP.UTC().Format("20060102T150405.000"),
+		entries[len(entries)-1].NTP.UTC().Format("20060102T150405.000"))
+
+	f, err := os.Create(filepath.Join(clipsDir, fileName))
+	if err != nil {
+		log.Printf("clip: %s", err.Error())
+		http.Error(w, "unable to create clip", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if err := clip.Write(f, s.mimeType, entries); err != nil {
+		os.Remove(f.Name())
+		if errors.Is(err, clip.ErrUnsupportedCodec) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		log.Printf("clip: %s", err.Error())
+		http.Error(w, "unable to write clip", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&clipResponse{ //nolint:errcheck
+		URL:   "/clips/" + fileName,
+		Start: entries[0].NTP,
+		End:   entries[len(entries)-1].NTP,
+	})
+}
+
+// serveClipFile serves the clips of clipsDir to the viewers of their stream.
+func serveClipFile(w http.ResponseWriter, r *http.Request) {
+	name, ok := clipStreamName(path.Base(r.URL.Path))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if _, ok := authorizeViewer(w, r, name); !ok {
+		return
+	}
+	http.StripPrefix("/clips/", http.FileServer(http.Dir(clipsDir))).ServeHTTP(w, r)
+}
+
+// clipStreamName returns the stream of a clip named <stream>_<start>_<end>.mp4 by serveClip,
+// the times don't contain '_'.
+func clipStreamName(fileName string) (string, bool) {
+	parts := strings.Split(strings.TrimSuffix(fileName, ".mp4"), "_")
+	if len(parts) < 3 || !strings.HasSuffix(fileName, ".mp4") {
+		return "", false
+	}
+	return strings.Join(parts[:len(parts)-2], "_"), true
+}
+
+type streamStats struct {
+	Name      string       `json:"name"`
+	MimeType  string       `json:"mimeType"`
+	Viewers   int          `json:"viewers"`
+	Stalled   bool         `json:"stalled"`
+	Source    *sourceStats `json:"source,omitempty"`
+	SubSource *sourceStats `json:"subSource,omitempty"`
+	Peers     []*peerStats `json:"peers"`
+}
+
+func serveStats(w http.ResponseWriter, s *liveStream) {
+	viewers, _ := s.viewerCount()
+	stalled, _ := s.stalledState()
+	stats := &streamStats{
+		Name:     s.name,
+		MimeType: s.mimeType,
+		Viewers:  viewers,
+		Stalled:  stalled,
+	}
+	if s.source != nil {
+		stats.Source = s.source.stats()
+	}
+	if s.sub != nil {
+		stats.SubSource = s.sub.source.stats()
+	}
+	stats.Peers = s.peerStats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats) //nolint:errcheck
+}
+
+// serveSnapshot returns the most recent key frame as a single-frame MP4,
+// or as raw Annex-B when format=h264 is requested.
+func serveSnapshot(w http.ResponseWriter, r *http.Request, s *liveStream) {
+	seq, ok := s.dvr.LatestKeyFrame()
+	if !ok {
+		http.Error(w, "no key frame received yet", http.StatusServiceUnavailable)
+		return
+	}
+	e, _, _ := s.dvr.Read(seq)
+	if e == nil {
+		http.Error(w, "no key frame received yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	au := withParams(s.currentFormat(), e.AU)
+
+	switch f := r.URL.Query().Get("format"); f {
+	case "h264", "h265":
+		if codecLookup[f] != s.mimeType {
+			http.Error(w, fmt.Sprintf("format %s doesn't match the codec of the stream", f), http.StatusBadRequest)
+			return
+		}
+
+		// Annex-B is the same for both codecs
+		byts, err := h264.AnnexBMarshal(au)
+		if err != nil {
+			log.Printf("snapshot: %s", err.Error())
+			http.Error(w, "unable to encode snapshot", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "video/"+f)
+		w.Write(byts) //nolint:errcheck
+
+	case "", "mp4":
+		var buf seekablebuffer.Buffer
+		err := clip.Write(&buf, s.mimeType, []*dvr.Entry{{
+			NTP:      e.NTP,
+			PTS:      e.PTS,
+			AU:       au,
+			KeyFrame: true,
+		}})
+		if errors.Is(err, clip.ErrUnsupportedCodec) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			log.Printf("snapshot: %s", err.Error())
+			http.Error(w, "unable to encode snapshot", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(buf.Bytes()) //nolint:errcheck
+
+	default:
+		http.Error(w, "unsupported format", http.StatusBadRequest)
+	}
+}
+
+// withParams replaces the parameter sets of a key frame with the latest ones of the format.
+func withParams(forma format.Format, au [][]byte) [][]byte {
+	var params [][]byte
+	var isParam func(nalu []byte) bool
+
+	switch forma := forma.(type) {
+	case *format.H264:
+		sps, pps := forma.SafeParams()
+		if sps == nil || pps == nil {
+			return au
+		}
+		params = [][]byte{sps, pps}
+		isParam = func(nalu []byte) bool {
+			typ := h264.NALUType(nalu[0] & 0x1F)
+			return typ == h264.NALUTypeSPS || typ == h264.NALUTypePPS
+		}
+
+	case *format.H265:
+		vps, sps, pps := forma.SafeParams()
+		if vps == nil || sps == nil || pps == nil {
+			return au
+		}
+		params = [][]byte{vps, sps, pps}
+		isParam = func(nalu []byte) bool {
+			typ := h265.NALUType((nalu[0] >> 1) & 0b111111)
+			return typ == h265.NALUType_VPS_NUT || typ == h265.NALUType_SPS_NUT || typ == h265.NALUType_PPS_NUT
+		}
+
+	default:
+		return au
+	}
+
+	ret := params
+	for _, nalu := range au {
+		if !isParam(nalu) {
+			ret = append(ret, nalu)
+		}
+	}
+	return ret
+}
+
+// parseClipTime parses either a RFC3339 time or a duration relative to now.
+func parseClipTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
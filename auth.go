@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// viewerAuthenticator grants viewers access to streams.
+type viewerAuthenticator interface {
+	// authorize returns whether r can view the stream called name and until when,
+	// the zero time when access doesn't expire.
+	authorize(r *http.Request, name string) (time.Time, bool)
+}
+
+// viewerAuthenticators are tried in order, the first one granting access wins.
+// Viewers are not authenticated when the list is empty.
+var viewerAuthenticators []viewerAuthenticator
+
+// newViewerAuthenticators returns the authenticators enabled by c.
+func newViewerAuthenticators(c *viewerAuthConf) ([]viewerAuthenticator, error) {
+	var auths []viewerAuthenticator
+	if len(c.Tokens) != 0 {
+		auths = append(auths, bearerTokens(c.Tokens))
+	}
+	if len(c.Users) != 0 {
+		auths = append(auths, basicUsers(c.Users))
+	}
+	if c.URLSigningKey != "" {
+		auths = append(auths, urlSigner([]byte(c.URLSigningKey)))
+	}
+	if c.JWTKeySetFile != "" {
+		v, err := newJWTValidator(c.JWTKeySetFile)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, v)
+	}
+	return auths, nil
+}
+
+// bearerTokens grants access to all streams to the holders of a token,
+// sent in the Authorization header or, for browsers, in the token query parameter.
+type bearerTokens []string
+
+func (t bearerTokens) authorize(r *http.Request, _ string) (time.Time, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		return time.Time{}, false
+	}
+
+	for _, expected := range t {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			return time.Time{}, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// bearerToken returns the token of the Authorization header or of the token query parameter.
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// basicUsers grants access to all streams to the users of HTTP basic authentication.
+type basicUsers []authConf
+
+func (u basicUsers) authorize(r *http.Request, _ string) (time.Time, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return time.Time{}, false
+	}
+
+	for _, expected := range u {
+		if subtle.ConstantTimeCompare([]byte(user), []byte(expected.User)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(pass), []byte(expected.Pass)) == 1 {
+			return time.Time{}, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// urlSigner grants access to a single stream with URLs carrying expires (Unix seconds)
+// and signature, the hex HMAC-SHA256 of "<stream>:<expires>".
+// Sessions opened before the deadline are not closed when it passes.
+type urlSigner []byte
+
+func (key urlSigner) authorize(r *http.Request, name string) (time.Time, bool) {
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return time.Time{}, false
+	}
+
+	signature, err := hex.DecodeString(q.Get("signature"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Time{}, hmac.Equal(signature, key.sign(name, expires))
+}
+
+func (key urlSigner) sign(name string, expires int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name + ":" + strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)
+}
+
+// authorizeViewer checks that r can view the stream called name and returns until when,
+// otherwise it writes a 401 response and returns false.
+func authorizeViewer(w http.ResponseWriter, r *http.Request, name string) (time.Time, bool) {
+	if len(viewerAuthenticators) == 0 {
+		return time.Time{}, true
+	}
+
+	for _, a := range viewerAuthenticators {
+		if expires, ok := a.authorize(r, name); ok {
+			return expires, true
+		}
+	}
+
+	// let browsers prompt for credentials
+	for _, a := range viewerAuthenticators {
+		if _, ok := a.(basicUsers); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+rtspRealm+`"`)
+		}
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return time.Time{}, false
+}
+
+// adminAuthenticators grant access to the endpoints managing the streams,
+// they are tried like viewerAuthenticators but the endpoints are refused when the list is empty.
+var adminAuthenticators []viewerAuthenticator
+
+// newAdminAuthenticators returns the authenticators enabled by c.
+func newAdminAuthenticators(c *adminAuthConf) []viewerAuthenticator {
+	var auths []viewerAuthenticator
+	if len(c.Tokens) != 0 {
+		auths = append(auths, bearerTokens(c.Tokens))
+	}
+	if len(c.Users) != 0 {
+		auths = append(auths, basicUsers(c.Users))
+	}
+	return auths
+}
+
+// withAdminAuth restricts h to administrators. It doesn't add CORS headers and refuses other origins,
+// so that pages of allowed origins can't send admin requests with the credentials of the browser.
+func withAdminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(r, origin) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		if len(adminAuthenticators) == 0 {
+			http.Error(w, "admin endpoints are disabled, set adminAuth to enable them", http.StatusForbidden)
+			return
+		}
+
+		for _, a := range adminAuthenticators {
+			if _, ok := a.authorize(r, ""); ok {
+				h(w, r)
+				return
+			}
+		}
+
+		for _, a := range adminAuthenticators {
+			if _, ok := a.(basicUsers); ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+rtspRealm+`"`)
+			}
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// jwtValidator grants access to the streams matching the glob patterns of the streams claim
+// of JWTs signed with HS256 or RS256 by a key of a JWK set, until they expire.
+type jwtValidator struct {
+	hmacKeys map[string][]byte
+	rsaKeys  map[string]*rsa.PublicKey
+}
+
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	Streams []string `json:"streams"`
+}
+
+// jwkSet is a JSON Web Key Set, see RFC 7517.
+type jwkSet struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		K   string `json:"k"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func newJWTValidator(keySetFile string) (*jwtValidator, error) {
+	byts, err := os.ReadFile(keySetFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var set jwkSet
+	if err := json.Unmarshal(byts, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", keySetFile, err)
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys found", keySetFile)
+	}
+
+	v := &jwtValidator{
+		hmacKeys: map[string][]byte{},
+		rsaKeys:  map[string]*rsa.PublicKey{},
+	}
+
+	for i, k := range set.Keys {
+		switch k.Kty {
+		case "oct":
+			key, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(key) == 0 {
+				return nil, fmt.Errorf("%s: keys[%d]: invalid k", keySetFile, i)
+			}
+			v.hmacKeys[k.Kid] = key
+
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("%s: keys[%d]: invalid n or e", keySetFile, i)
+			}
+			v.rsaKeys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+
+		default:
+			return nil, fmt.Errorf("%s: keys[%d]: unsupported key type '%s', expected oct or RSA", keySetFile, i, k.Kty)
+		}
+	}
+
+	return v, nil
+}
+
+// keys returns the keys which can verify token,
+// the one named by the kid header or, without it, all the keys of the algorithm.
+func (v *jwtValidator) keys(token *jwt.Token) (interface{}, error) {
+	kid, hasKid := token.Header["kid"].(string)
+
+	var keys []jwt.VerificationKey
+	switch token.Method.Alg() {
+	case "HS256":
+		for id, k := range v.hmacKeys {
+			if !hasKid || id == kid {
+				keys = append(keys, k)
+			}
+		}
+	case "RS256":
+		for id, k := range v.rsaKeys {
+			if !hasKid || id == kid {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no matching key")
+	}
+	return jwt.VerificationKeySet{Keys: keys}, nil
+}
+
+func (v *jwtValidator) authorize(r *http.Request, name string) (time.Time, bool) {
+	raw := bearerToken(r)
+	if raw == "" {
+		return time.Time{}, false
+	}
+
+	var claims jwtClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, v.keys,
+		jwt.WithValidMethods([]string{"HS256", "RS256"}),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	for _, pattern := range claims.Streams {
+		if ok, _ := path.Match(pattern, name); ok {
+			return claims.ExpiresAt.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// viewerStreamName returns the stream requested by a viewer, the default one when it doesn't pick one.
+func viewerStreamName(r *http.Request) string {
+	if name := r.URL.Query().Get("stream"); name != "" {
+		return name
+	}
+	return defaultStream()
+}
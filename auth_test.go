@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestBearerTokens(t *testing.T) {
+	auth := bearerTokens{"secret", "other"}
+
+	for _, ca := range []struct {
+		name   string
+		header string
+		query  string
+		ok     bool
+	}{
+		{"header", "Bearer secret", "", true},
+		{"second token", "Bearer other", "", true},
+		{"query", "", "token=secret", true},
+		{"wrong token", "Bearer secre", "", false},
+		{"longer token", "Bearer secret2", "", false},
+		{"basic scheme", "Basic secret", "", false},
+		{"missing", "", "", false},
+		{"empty query", "", "token=", false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/?"+ca.query, nil)
+			if ca.header != "" {
+				r.Header.Set("Authorization", ca.header)
+			}
+
+			_, ok := auth.authorize(r, "cam1")
+			if ok != ca.ok {
+				t.Errorf("expected %v, got %v", ca.ok, ok)
+			}
+		})
+	}
+}
+
+func TestBasicUsers(t *testing.T) {
+	auth := basicUsers{{User: "viewer", Pass: "pass"}}
+
+	for _, ca := range []struct {
+		name string
+		user string
+		pass string
+		set  bool
+		ok   bool
+	}{
+		{"valid", "viewer", "pass", true, true},
+		{"wrong pass", "viewer", "pas", true, false},
+		{"wrong user", "admin", "pass", true, false},
+		{"empty pass", "viewer", "", true, false},
+		{"missing", "", "", false, false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if ca.set {
+				r.SetBasicAuth(ca.user, ca.pass)
+			}
+
+			_, ok := auth.authorize(r, "cam1")
+			if ok != ca.ok {
+				t.Errorf("expected %v, got %v", ca.ok, ok)
+			}
+		})
+	}
+}
+
+func TestURLSigner(t *testing.T) {
+	key := urlSigner("secret-key")
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Second).Unix()
+
+	sign := func(key urlSigner, name string, expires int64) string {
+		return hex.EncodeToString(key.sign(name, expires))
+	}
+
+	for _, ca := range []struct {
+		name      string
+		expires   string
+		signature string
+		ok        bool
+	}{
+		{"valid", strconv.FormatInt(future, 10), sign(key, "cam1", future), true},
+		{"expired", strconv.FormatInt(past, 10), sign(key, "cam1", past), false},
+		{"expiry changed", strconv.FormatInt(future+1, 10), sign(key, "cam1", future), false},
+		{"other stream", strconv.FormatInt(future, 10), sign(key, "cam2", future), false},
+		{"other key", strconv.FormatInt(future, 10), sign(urlSigner("forged"), "cam1", future), false},
+		{"truncated signature", strconv.FormatInt(future, 10), sign(key, "cam1", future)[:32], false},
+		{"invalid signature", strconv.FormatInt(future, 10), "zz", false},
+		{"missing signature", strconv.FormatInt(future, 10), "", false},
+		{"missing expires", "", sign(key, "cam1", future), false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/?stream=cam1&expires="+ca.expires+"&signature="+ca.signature, nil)
+
+			_, ok := key.authorize(r, "cam1")
+			if ok != ca.ok {
+				t.Errorf("expected %v, got %v", ca.ok, ok)
+			}
+		})
+	}
+}
+
+func TestJWTValidator(t *testing.T) {
+	hmacKey := []byte("0123456789abcdef0123456789abcdef")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keySetFile := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(keySetFile, []byte(`{"keys": [`+
+		`{"kty": "oct", "kid": "hmac", "k": "`+base64.RawURLEncoding.EncodeToString(hmacKey)+`"},`+
+		`{"kty": "RSA", "kid": "rsa", "n": "`+base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes())+
+		`", "e": "`+base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())+`"}`+
+		`]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := newJWTValidator(keySetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		raw, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	claims := func(exp time.Time, streams ...string) jwt.MapClaims {
+		c := jwt.MapClaims{"streams": streams}
+		if !exp.IsZero() {
+			c["exp"] = exp.Unix()
+		}
+		return c
+	}
+
+	for _, ca := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"HS256", sign(jwt.SigningMethodHS256, "hmac", hmacKey, claims(exp, "cam1")), true},
+		{"HS256 without kid", sign(jwt.SigningMethodHS256, "", hmacKey, claims(exp, "cam1")), true},
+		{"RS256", sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims(exp, "cam1")), true},
+		{"RS256 without kid", sign(jwt.SigningMethodRS256, "", rsaKey, claims(exp, "cam1")), true},
+		{"glob", sign(jwt.SigningMethodHS256, "hmac", hmacKey, claims(exp, "lobby", "cam*")), true},
+		{"other stream", sign(jwt.SigningMethodHS256, "hmac", hmacKey, claims(exp, "cam2", "lobby*")), false},
+		{"no streams", sign(jwt.SigningMethodHS256, "hmac", hmacKey, claims(exp)), false},
+		{"expired", sign(jwt.SigningMethodHS256, "hmac", hmacKey, claims(time.Now().Add(-time.Minute), "cam1")), false},
+		{"without exp", sign(jwt.SigningMethodHS256, "hmac", hmacKey, claims(time.Time{}, "cam1")), false},
+		{"unknown kid", sign(jwt.SigningMethodHS256, "other", hmacKey, claims(exp, "cam1")), false},
+		{"kid of the other algorithm", sign(jwt.SigningMethodHS256, "rsa", hmacKey, claims(exp, "cam1")), false},
+		{"forged HMAC", sign(jwt.SigningMethodHS256, "hmac", []byte("forged"), claims(exp, "cam1")), false},
+		{"forged RSA", sign(jwt.SigningMethodRS256, "rsa", otherRSAKey, claims(exp, "cam1")), false},
+		{"HMAC with the RSA public key", sign(jwt.SigningMethodHS256, "rsa", rsaKey.N.Bytes(), claims(exp, "cam1")), false},
+		{"HS384", sign(jwt.SigningMethodHS384, "hmac", hmacKey, claims(exp, "cam1")), false},
+		{"none", sign(jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, claims(exp, "cam1")), false},
+		{"garbage", "not.a.token", false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+ca.token)
+
+			expires, ok := v.authorize(r, "cam1")
+			if ok != ca.ok {
+				t.Fatalf("expected %v, got %v", ca.ok, ok)
+			}
+			if ok && !expires.Equal(exp) {
+				t.Errorf("expected expiry %v, got %v", exp, expires)
+			}
+		})
+	}
+}
+
+func TestNewJWTValidatorErrors(t *testing.T) {
+	for _, ca := range []struct {
+		name   string
+		keySet string
+	}{
+		{"invalid JSON", `{"keys": `},
+		{"no keys", `{"keys": []}`},
+		{"empty oct key", `{"keys": [{"kty": "oct", "k": ""}]}`},
+		{"invalid RSA key", `{"keys": [{"kty": "RSA", "n": "AQAB", "e": "!"}]}`},
+		{"unsupported key type", `{"keys": [{"kty": "EC"}]}`},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			keySetFile := filepath.Join(t.TempDir(), "jwks.json")
+			if err := os.WriteFile(keySetFile, []byte(ca.keySet), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := newJWTValidator(keySetFile); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestAuthorizeViewer(t *testing.T) {
+	defer func(auths []viewerAuthenticator) { viewerAuthenticators = auths }(viewerAuthenticators)
+
+	viewerAuthenticators = nil
+	w := httptest.NewRecorder()
+	if _, ok := authorizeViewer(w, httptest.NewRequest(http.MethodGet, "/", nil), "cam1"); !ok {
+		t.Error("viewers must not be authenticated without authenticators")
+	}
+
+	viewerAuthenticators = []viewerAuthenticator{bearerTokens{"secret"}, basicUsers{{User: "viewer", Pass: "pass"}}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("viewer", "pass")
+	if _, ok := authorizeViewer(httptest.NewRecorder(), r, "cam1"); !ok {
+		t.Error("expected the basic user to be authorized")
+	}
+
+	w = httptest.NewRecorder()
+	if _, ok := authorizeViewer(w, httptest.NewRequest(http.MethodGet, "/?token=forged", nil), "cam1"); ok {
+		t.Fatal("expected the forged token to be refused")
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("expected a basic authentication challenge")
+	}
+}
+
+func TestWithAdminAuth(t *testing.T) {
+	defer func(auths []viewerAuthenticator) { adminAuthenticators = auths }(adminAuthenticators)
+
+	for _, ca := range []struct {
+		name   string
+		auths  []viewerAuthenticator
+		token  string
+		origin string
+		code   int
+	}{
+		{"disabled", nil, "admin", "", http.StatusForbidden},
+		{"valid", []viewerAuthenticator{bearerTokens{"admin"}}, "admin", "", http.StatusOK},
+		{"same origin", []viewerAuthenticator{bearerTokens{"admin"}}, "admin", "http://bridge.example.com", http.StatusOK},
+		{"other origin", []viewerAuthenticator{bearerTokens{"admin"}}, "admin", "http://portal.example.com", http.StatusForbidden},
+		{"forged token", []viewerAuthenticator{bearerTokens{"admin"}}, "forged", "", http.StatusUnauthorized},
+		{"missing token", []viewerAuthenticator{bearerTokens{"admin"}}, "", "", http.StatusUnauthorized},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			adminAuthenticators = ca.auths
+
+			r := httptest.NewRequest(http.MethodPost, "http://bridge.example.com/api/reload", nil)
+			if ca.token != "" {
+				r.Header.Set("Authorization", "Bearer "+ca.token)
+			}
+			if ca.origin != "" {
+				r.Header.Set("Origin", ca.origin)
+			}
+
+			w := httptest.NewRecorder()
+			withAdminAuth(func(w http.ResponseWriter, r *http.Request) {})(w, r)
+			if w.Code != ca.code {
+				t.Errorf("expected status %d, got %d", ca.code, w.Code)
+			}
+			if w.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Error("admin endpoints must not send CORS headers")
+			}
+		})
+	}
+}
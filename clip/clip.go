@@ -0,0 +1,127 @@
+// Package clip writes buffered access units into MP4 files.
+package clip
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/pion/webrtc/v4"
+
+	"github.com/nicksanford/rtspwebrtcbridge/dvr"
+)
+
+const (
+	videoTrackID   = 1
+	videoTimeScale = 90000
+
+	// duration of the last sample when it can't be derived from the previous one
+	defaultSampleDuration = videoTimeScale / 30
+)
+
+var (
+	// ErrNoKeyFrame is returned when a clip doesn't begin with a key frame.
+	ErrNoKeyFrame = errors.New("clip doesn't begin with a key frame")
+
+	// ErrUnsupportedCodec is returned when the codec can't be stored in MP4 clips.
+	ErrUnsupportedCodec = errors.New("codec not supported by clips")
+)
+
+// Write writes entries into w as a fragmented MP4 file.
+// The first entry must be a key frame carrying the parameter sets.
+func Write(w io.WriteSeeker, mimeType string, entries []*dvr.Entry) error {
+	if len(entries) == 0 || !entries[0].KeyFrame {
+		return ErrNoKeyFrame
+	}
+
+	codec, err := codecFromAU(mimeType, entries[0].AU)
+	if err != nil {
+		return err
+	}
+
+	init := &fmp4.Init{
+		Tracks: []*fmp4.InitTrack{{
+			ID:        videoTrackID,
+			TimeScale: videoTimeScale,
+			Codec:     codec,
+		}},
+	}
+	if err := init.Marshal(w); err != nil {
+		return err
+	}
+
+	samples := make([]*fmp4.PartSample, len(entries))
+	for i, e := range entries {
+		sample, err := fmp4.NewPartSampleH26x(0, e.KeyFrame, e.AU)
+		if err != nil {
+			return err
+		}
+
+		if i < len(entries)-1 {
+			sample.Duration = durationToTimeScale(entries[i+1].PTS - e.PTS)
+		} else if i > 0 {
+			sample.Duration = samples[i-1].Duration
+		} else {
+			sample.Duration = defaultSampleDuration
+		}
+		samples[i] = sample
+	}
+
+	part := &fmp4.Part{
+		SequenceNumber: 1,
+		Tracks: []*fmp4.PartTrack{{
+			ID:      videoTrackID,
+			Samples: samples,
+		}},
+	}
+	return part.Marshal(w)
+}
+
+func codecFromAU(mimeType string, au [][]byte) (fmp4.Codec, error) {
+	switch mimeType {
+	case webrtc.MimeTypeH264:
+		codec := &fmp4.CodecH264{}
+		for _, nalu := range au {
+			switch h264.NALUType(nalu[0] & 0x1F) {
+			case h264.NALUTypeSPS:
+				codec.SPS = nalu
+			case h264.NALUTypePPS:
+				codec.PPS = nalu
+			}
+		}
+		if codec.SPS == nil || codec.PPS == nil {
+			return nil, errors.New("SPS or PPS not found")
+		}
+		return codec, nil
+
+	case webrtc.MimeTypeH265:
+		codec := &fmp4.CodecH265{}
+		for _, nalu := range au {
+			switch h265.NALUType((nalu[0] >> 1) & 0b111111) {
+			case h265.NALUType_VPS_NUT:
+				codec.VPS = nalu
+			case h265.NALUType_SPS_NUT:
+				codec.SPS = nalu
+			case h265.NALUType_PPS_NUT:
+				codec.PPS = nalu
+			}
+		}
+		if codec.VPS == nil || codec.SPS == nil || codec.PPS == nil {
+			return nil, errors.New("VPS, SPS or PPS not found")
+		}
+		return codec, nil
+
+	default:
+		return nil, ErrUnsupportedCodec
+	}
+}
+
+func durationToTimeScale(d time.Duration) uint32 {
+	if d < 0 {
+		return 0
+	}
+	return uint32(d * videoTimeScale / time.Second)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/pion/interceptor/pkg/flexfec"
+	"github.com/pion/webrtc/v4"
+	"gopkg.in/yaml.v3"
+)
+
+var codecLookup = map[string]string{"h264": webrtc.MimeTypeH264, "h265": webrtc.MimeTypeH265, "vp8": webrtc.MimeTypeVP8}
+
+var outputLookup = map[string]struct{}{"webrtc": {}, "rtsp": {}}
+
+const defaultOnDemandCloseAfter = 10 * time.Second
+
+var streamNameRegexp = regexp.MustCompile(`^[0-9a-zA-Z_\-.]+$`)
+
+// conf is the configuration of the bridge,
+// read from the file passed with -config or built from the command line flags.
+type conf struct {
+	HTTPListenAddress  string           `yaml:"httpListenAddress"`
+	TLS                tlsConf          `yaml:"tls"`
+	ViewerAuth         viewerAuthConf   `yaml:"viewerAuth"`
+	AdminAuth          adminAuthConf    `yaml:"adminAuth"`
+	AllowedOrigins     []string         `yaml:"allowedOrigins"`
+	MaxViewers         int              `yaml:"maxViewers"`
+	MaxViewersPerIP    int              `yaml:"maxViewersPerIP"`
+	RTSPListenAddress  string           `yaml:"rtspListenAddress"`
+	RTSPUDPRTPAddress  string           `yaml:"rtspUDPRTPAddress"`
+	RTSPUDPRTCPAddress string           `yaml:"rtspUDPRTCPAddress"`
+	ICE                iceConf          `yaml:"ice"`
+	LossRecovery       lossRecoveryConf `yaml:"lossRecovery"`
+	DVRWindow          time.Duration    `yaml:"dvrWindow"`
+	ClipsDir           string           `yaml:"clipsDir"`
+	Streams            []*streamConf    `yaml:"streams"`
+}
+
+// tlsConf enables HTTPS when both files are set, they are reloaded when they change.
+type tlsConf struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// viewerAuthConf enables the authentication of viewers when any of its fields is set.
+type viewerAuthConf struct {
+	// static bearer tokens
+	Tokens []string `yaml:"tokens"`
+	// users of HTTP basic authentication
+	Users []authConf `yaml:"users"`
+	// key of HMAC-signed expiring URLs
+	URLSigningKey string `yaml:"urlSigningKey"`
+	// JWK set verifying JWTs which grant access to the streams of their streams claim
+	JWTKeySetFile string `yaml:"jwtKeySetFile"`
+}
+
+// adminAuthConf grants access to the endpoints managing the streams, which are refused when it is empty.
+type adminAuthConf struct {
+	// static bearer tokens
+	Tokens []string `yaml:"tokens"`
+	// users of HTTP basic authentication
+	Users []authConf `yaml:"users"`
+}
+
+type iceConf struct {
+	Servers    []iceServerConf `yaml:"servers"`
+	NAT1To1IPs []string        `yaml:"nat1To1IPs"`
+	UDPPortMin uint16          `yaml:"udpPortMin"`
+	UDPPortMax uint16          `yaml:"udpPortMax"`
+}
+
+// lossRecoveryConf protects the video sent to viewers on lossy networks.
+type lossRecoveryConf struct {
+	// retransmit the packets reported lost on a separate RTX stream, instead of the video stream
+	RTX bool `yaml:"rtx"`
+	// FlexFEC packets sent for every FECGroup video packets, 0 to disable FEC
+	FECPackets int `yaml:"fecPackets"`
+	FECGroup   int `yaml:"fecGroup"`
+}
+
+type iceServerConf struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+}
+
+// streamConf is a stream either pulled from Source or, when Source is empty, fed by publishers.
+type streamConf struct {
+	Name   string `yaml:"name"`
+	Source string `yaml:"source"`
+	Codec  string `yaml:"codec"`
+
+	// used in order when the source fails or stalls
+	BackupSources []string `yaml:"backupSources"`
+
+	// lower resolution rendition of the source, offered to viewers with little bandwidth
+	SubSource string `yaml:"subSource"`
+
+	Transport    string        `yaml:"transport"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	StallTimeout time.Duration `yaml:"stallTimeout"`
+	AnyPort      bool          `yaml:"anyPort"`
+	SourceTLS    sourceTLSConf `yaml:"sourceTLS"`
+
+	// pull the source only while there are viewers
+	OnDemand           bool          `yaml:"onDemand"`
+	OnDemandCloseAfter time.Duration `yaml:"onDemandCloseAfter"`
+
+	// credentials used to pull the source, or required from publishers
+	Auth authConf `yaml:"auth"`
+
+	// maximum number of WebRTC viewers, 0 for unlimited
+	MaxViewers int `yaml:"maxViewers"`
+
+	// defaults to all outputs
+	Outputs []string `yaml:"outputs"`
+}
+
+type sourceTLSConf struct {
+	CAFile      string `yaml:"caFile"`
+	Fingerprint string `yaml:"fingerprint"`
+	Insecure    bool   `yaml:"insecure"`
+}
+
+type authConf struct {
+	User string `yaml:"user"`
+	Pass string `yaml:"pass"`
+}
+
+// defaultConf returns the configuration fields which aren't related to streams,
+// set to the defaults of the command line flags.
+func defaultConf() *conf {
+	return &conf{
+		HTTPListenAddress:  ":8080",
+		RTSPListenAddress:  ":8555",
+		RTSPUDPRTPAddress:  ":8002",
+		RTSPUDPRTCPAddress: ":8003",
+		LossRecovery:       lossRecoveryConf{FECGroup: 10},
+		DVRWindow:          5 * time.Minute,
+		ClipsDir:           "clips",
+	}
+}
+
+func loadConf(path string) (*conf, error) {
+	byts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := defaultConf()
+	dec := yaml.NewDecoder(bytes.NewReader(byts))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *conf) validate() error {
+	if c.HTTPListenAddress == "" {
+		return errors.New("httpListenAddress: must be set")
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls: certFile and keyFile must be set together")
+	}
+
+	for i, t := range c.ViewerAuth.Tokens {
+		if t == "" {
+			return fmt.Errorf("viewerAuth.tokens[%d]: must not be empty", i)
+		}
+	}
+	for i, u := range c.ViewerAuth.Users {
+		if u.User == "" {
+			return fmt.Errorf("viewerAuth.users[%d].user: must be set", i)
+		}
+	}
+	for i, t := range c.AdminAuth.Tokens {
+		if t == "" {
+			return fmt.Errorf("adminAuth.tokens[%d]: must not be empty", i)
+		}
+	}
+	for i, u := range c.AdminAuth.Users {
+		if u.User == "" {
+			return fmt.Errorf("adminAuth.users[%d].user: must be set", i)
+		}
+	}
+
+	for i, o := range c.AllowedOrigins {
+		if _, err := path.Match(o, ""); err != nil {
+			return fmt.Errorf("allowedOrigins[%d]: invalid pattern '%s'", i, o)
+		}
+	}
+
+	if c.MaxViewers < 0 {
+		return errors.New("maxViewers: must not be negative")
+	}
+	if c.MaxViewersPerIP < 0 {
+		return errors.New("maxViewersPerIP: must not be negative")
+	}
+
+	for i, s := range c.ICE.Servers {
+		if len(s.URLs) == 0 {
+			return fmt.Errorf("ice.servers[%d].urls: must be set", i)
+		}
+	}
+	for i, ip := range c.ICE.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("ice.nat1To1IPs[%d]: invalid IP '%s'", i, ip)
+		}
+	}
+	if (c.ICE.UDPPortMin == 0) != (c.ICE.UDPPortMax == 0) || c.ICE.UDPPortMin > c.ICE.UDPPortMax {
+		return errors.New("ice: udpPortMin and udpPortMax must be set together and form a valid range")
+	}
+
+	if c.LossRecovery.FECPackets < 0 {
+		return errors.New("lossRecovery.fecPackets: must not be negative")
+	}
+	if c.LossRecovery.FECPackets != 0 {
+		if c.LossRecovery.FECGroup <= 0 || c.LossRecovery.FECGroup > int(flexfec.MaxMediaPackets) {
+			return fmt.Errorf("lossRecovery.fecGroup: must be between 1 and %d", flexfec.MaxMediaPackets)
+		}
+		if c.LossRecovery.FECPackets > c.LossRecovery.FECGroup {
+			return errors.New("lossRecovery.fecPackets: must not exceed fecGroup")
+		}
+	}
+
+	if c.DVRWindow <= 0 {
+		return errors.New("dvrWindow: must be positive")
+	}
+
+	if c.ClipsDir == "" {
+		return errors.New("clipsDir: must be set")
+	}
+
+	if len(c.Streams) == 0 {
+		return errors.New("streams: at least one stream is required")
+	}
+
+	names := make(map[string]struct{})
+	for i, s := range c.Streams {
+		if s == nil {
+			return fmt.Errorf("streams[%d]: must not be empty", i)
+		}
+		if err := c.validateStream(s); err != nil {
+			return fmt.Errorf("streams[%d]: %w", i, err)
+		}
+
+		if _, ok := names[s.Name]; ok {
+			return fmt.Errorf("streams[%d].name: duplicate name '%s'", i, s.Name)
+		}
+		names[s.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// validateStream checks s against the rest of the configuration and fills its defaults.
+func (c *conf) validateStream(s *streamConf) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	if c.RTSPListenAddress == "" {
+		for i, o := range s.Outputs {
+			if o == "rtsp" {
+				return fmt.Errorf("outputs[%d]: rtsp requires rtspListenAddress", i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate checks s and fills the defaults.
+func (s *streamConf) validate() error {
+	if !streamNameRegexp.MatchString(s.Name) {
+		return fmt.Errorf("name: invalid name '%s', it can contain only alphanumeric characters, '_', '-' and '.'", s.Name)
+	}
+
+	if _, ok := codecLookup[s.Codec]; !ok {
+		return fmt.Errorf("codec: invalid codec '%s', expected h264, h265 or vp8", s.Codec)
+	}
+
+	if s.Source != "" {
+		if err := validateSourceURL(s.Source); err != nil {
+			return fmt.Errorf("source: %w", err)
+		}
+	}
+
+	if s.SubSource != "" {
+		if err := validateSourceURL(s.SubSource); err != nil {
+			return fmt.Errorf("subSource: %w", err)
+		}
+	}
+
+	for i, b := range s.BackupSources {
+		if err := validateSourceURL(b); err != nil {
+			return fmt.Errorf("backupSources[%d]: %w", i, err)
+		}
+	}
+
+	if s.Transport == "" {
+		s.Transport = "auto"
+	}
+	if _, ok := transportLookup[s.Transport]; !ok {
+		return fmt.Errorf("transport: invalid transport '%s', expected auto, udp, multicast or tcp", s.Transport)
+	}
+
+	if s.ReadTimeout < 0 {
+		return errors.New("readTimeout: must not be negative")
+	}
+	if s.WriteTimeout < 0 {
+		return errors.New("writeTimeout: must not be negative")
+	}
+	if s.StallTimeout < 0 {
+		return errors.New("stallTimeout: must not be negative")
+	}
+	if s.StallTimeout != 0 && s.StallTimeout < minStallTimeout {
+		return fmt.Errorf("stallTimeout: must be at least %s", minStallTimeout)
+	}
+	if s.Source != "" && s.StallTimeout == 0 {
+		s.StallTimeout = defaultStallTimeout
+	}
+
+	if _, err := s.sourceConf().tlsConfig(); err != nil {
+		return fmt.Errorf("sourceTLS: %w", err)
+	}
+
+	if s.OnDemandCloseAfter < 0 {
+		return errors.New("onDemandCloseAfter: must not be negative")
+	}
+	if s.OnDemand && s.OnDemandCloseAfter == 0 {
+		s.OnDemandCloseAfter = defaultOnDemandCloseAfter
+	}
+
+	if s.Source == "" && (s.Transport != "auto" || s.ReadTimeout != 0 || s.WriteTimeout != 0 || s.StallTimeout != 0 || s.AnyPort ||
+		s.SourceTLS != sourceTLSConf{} || s.OnDemand || len(s.BackupSources) != 0 || s.SubSource != "") {
+		return errors.New("transport, timeouts, anyPort, sourceTLS, onDemand, backupSources and subSource require a source")
+	}
+
+	if s.MaxViewers < 0 {
+		return errors.New("maxViewers: must not be negative")
+	}
+
+	for i, o := range s.Outputs {
+		if _, ok := outputLookup[o]; !ok {
+			return fmt.Errorf("outputs[%d]: invalid output '%s', expected webrtc or rtsp", i, o)
+		}
+	}
+
+	return nil
+}
+
+func validateSourceURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "rtsp" && u.Scheme != "rtsps" {
+		return fmt.Errorf("unsupported scheme '%s', expected rtsp or rtsps", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("host is missing")
+	}
+	return nil
+}
+
+func (s *streamConf) hasOutput(output string) bool {
+	if len(s.Outputs) == 0 {
+		return true
+	}
+	for _, o := range s.Outputs {
+		if o == output {
+			return true
+		}
+	}
+	return false
+}
+
+// subStreamConf returns the configuration of the stream pulling the sub source of s,
+// which shares the settings of the source.
+func (s *streamConf) subStreamConf() *streamConf {
+	sub := *s
+	sub.Name = s.Name + ".sub"
+	sub.Source = s.SubSource
+	sub.BackupSources = nil
+	sub.SubSource = ""
+	sub.MaxViewers = 0
+	sub.Outputs = []string{"webrtc"}
+	return &sub
+}
+
+// sourceConf returns the configuration of the RTSP source of s,
+// the credentials are added to the source URLs.
+func (s *streamConf) sourceConf() rtspSourceConf {
+	urls := append([]string{s.Source}, s.BackupSources...)
+	if s.Auth.User != "" {
+		for i, rawURL := range urls {
+			if u, err := url.Parse(rawURL); err == nil {
+				u.User = url.UserPassword(s.Auth.User, s.Auth.Pass)
+				urls[i] = u.String()
+			}
+		}
+	}
+
+	return rtspSourceConf{
+		urls:               urls,
+		transport:          s.Transport,
+		readTimeout:        s.ReadTimeout,
+		writeTimeout:       s.WriteTimeout,
+		stallTimeout:       s.StallTimeout,
+		anyPortEnable:      s.AnyPort,
+		caFile:             s.SourceTLS.CAFile,
+		fingerprint:        s.SourceTLS.Fingerprint,
+		insecure:           s.SourceTLS.Insecure,
+		onDemand:           s.OnDemand,
+		onDemandCloseAfter: s.OnDemandCloseAfter,
+	}
+}
+
+// settingEngine returns the WebRTC settings derived from the ICE configuration.
+func (c *iceConf) settingEngine() (webrtc.SettingEngine, error) {
+	se := webrtc.SettingEngine{}
+	if len(c.NAT1To1IPs) != 0 {
+		se.SetNAT1To1IPs(c.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+	if c.UDPPortMin != 0 {
+		if err := se.SetEphemeralUDPPortRange(c.UDPPortMin, c.UDPPortMax); err != nil {
+			return se, err
+		}
+	}
+	return se, nil
+}
+
+func (c *iceConf) iceServers() []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, len(c.Servers))
+	for i, s := range c.Servers {
+		servers[i] = webrtc.ICEServer{
+			URLs:       s.URLs,
+			Username:   s.Username,
+			Credential: s.Credential,
+		}
+	}
+	return servers
+}
@@ -0,0 +1,143 @@
+// Package dvr keeps a rolling window of access units in memory so that viewers
+// can rewind into a live stream.
+package dvr
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry is an access unit stored in the buffer.
+type Entry struct {
+	NTP      time.Time
+	PTS      time.Duration
+	AU       [][]byte
+	KeyFrame bool
+}
+
+// Buffer is a rolling window of access units.
+// Entries are addressed by a sequence number which keeps increasing while
+// old entries are evicted, so readers can hold a position across evictions.
+type Buffer struct {
+	window time.Duration
+
+	mutex   sync.Mutex
+	entries []*Entry
+	first   uint64
+	wake    chan struct{}
+}
+
+// New allocates a Buffer that keeps the last window of access units.
+func New(window time.Duration) *Buffer {
+	return &Buffer{
+		window: window,
+		wake:   make(chan struct{}),
+	}
+}
+
+// Push appends an access unit and evicts the ones that fell out of the window.
+func (b *Buffer) Push(e *Entry) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.entries = append(b.entries, e)
+
+	n := 0
+	for n < len(b.entries)-1 && e.NTP.Sub(b.entries[n].NTP) > b.window {
+		n++
+	}
+	if n != 0 {
+		b.entries = b.entries[n:]
+		b.first += uint64(n)
+	}
+
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// KeyFrameBefore returns the position of the last key frame received at or
+// before t. If the buffer doesn't go back that far, the oldest key frame is
+// returned instead.
+func (b *Buffer) KeyFrameBefore(t time.Time) (uint64, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	i := b.keyFrameBefore(t)
+	if i < 0 {
+		return 0, false
+	}
+	return b.first + uint64(i), true
+}
+
+func (b *Buffer) keyFrameBefore(t time.Time) int {
+	found := -1
+	for i, e := range b.entries {
+		if !e.KeyFrame {
+			continue
+		}
+		if found >= 0 && e.NTP.After(t) {
+			break
+		}
+		found = i
+	}
+	return found
+}
+
+// LatestKeyFrame returns the position of the most recent key frame.
+func (b *Buffer) LatestKeyFrame() (uint64, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i := len(b.entries) - 1; i >= 0; i-- {
+		if b.entries[i].KeyFrame {
+			return b.first + uint64(i), true
+		}
+	}
+	return 0, false
+}
+
+// Read returns the entry at position seq and the position of the following one.
+// If seq has been evicted, reading restarts from the oldest key frame.
+// If seq hasn't been received yet, a nil entry is returned together with a
+// channel that is closed when a new entry is pushed.
+func (b *Buffer) Read(seq uint64) (*Entry, uint64, <-chan struct{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if seq < b.first {
+		seq = b.first
+		for i, e := range b.entries {
+			if e.KeyFrame {
+				seq = b.first + uint64(i)
+				break
+			}
+		}
+	}
+
+	i := seq - b.first
+	if i >= uint64(len(b.entries)) {
+		return nil, seq, b.wake
+	}
+	return b.entries[i], seq + 1, nil
+}
+
+// Range returns the entries received between start and end, beginning
+// at the key frame preceding start.
+func (b *Buffer) Range(start time.Time, end time.Time) []*Entry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	first := b.keyFrameBefore(start)
+	if first < 0 {
+		return nil
+	}
+
+	var ret []*Entry
+	for _, e := range b.entries[first:] {
+		if e.NTP.After(end) {
+			break
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
@@ -0,0 +1,188 @@
+package dvr
+
+import (
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fill pushes n access units 100ms apart, with a key frame every 10.
+func fill(b *Buffer, n int) {
+	for i := 0; i < n; i++ {
+		b.Push(&Entry{
+			NTP:      at(i),
+			PTS:      time.Duration(i) * 100 * time.Millisecond,
+			KeyFrame: i%10 == 0,
+		})
+	}
+}
+
+func at(i int) time.Time {
+	return t0.Add(time.Duration(i) * 100 * time.Millisecond)
+}
+
+func TestPushEvicts(t *testing.T) {
+	b := New(time.Second)
+	fill(b, 30)
+
+	// the last second, from 1.9s to 2.9s
+	if b.first != 19 || len(b.entries) != 11 {
+		t.Fatalf("expected entries 19 to 29, got %d entries from %d", len(b.entries), b.first)
+	}
+	if !b.entries[0].NTP.Equal(at(19)) {
+		t.Errorf("expected the oldest entry at %v, got %v", at(19), b.entries[0].NTP)
+	}
+}
+
+func TestPushKeepsLatest(t *testing.T) {
+	b := New(time.Second)
+	b.Push(&Entry{NTP: t0})
+	b.Push(&Entry{NTP: t0.Add(time.Hour)})
+
+	if b.first != 1 || len(b.entries) != 1 {
+		t.Errorf("expected the latest entry only, got %d entries from %d", len(b.entries), b.first)
+	}
+}
+
+func TestRead(t *testing.T) {
+	b := New(time.Second)
+	fill(b, 30)
+
+	for _, ca := range []struct {
+		name string
+		seq  uint64
+		want uint64
+	}{
+		{"evicted", 0, 20},
+		{"oldest", 19, 19},
+		{"key frame", 20, 20},
+		{"latest", 29, 29},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			e, next, wake := b.Read(ca.seq)
+			if e == nil || wake != nil {
+				t.Fatal("expected an entry")
+			}
+			if !e.NTP.Equal(at(int(ca.want))) || next != ca.want+1 {
+				t.Errorf("expected entry %d, got %v and next %d", ca.want, e.NTP, next)
+			}
+		})
+	}
+}
+
+func TestReadWaits(t *testing.T) {
+	b := New(time.Second)
+	fill(b, 5)
+
+	e, next, wake := b.Read(5)
+	if e != nil || next != 5 || wake == nil {
+		t.Fatal("expected to wait for entry 5")
+	}
+
+	select {
+	case <-wake:
+		t.Fatal("woken before a push")
+	default:
+	}
+
+	fill(b, 1)
+	select {
+	case <-wake:
+	default:
+		t.Fatal("expected a push to wake readers")
+	}
+
+	if e, _, _ := b.Read(5); e == nil {
+		t.Error("expected entry 5 after the push")
+	}
+}
+
+func TestKeyFrameBefore(t *testing.T) {
+	b := New(5 * time.Second)
+	if _, ok := b.KeyFrameBefore(t0); ok {
+		t.Error("expected no key frame in an empty buffer")
+	}
+
+	fill(b, 35)
+
+	for _, ca := range []struct {
+		name string
+		t    time.Time
+		want uint64
+	}{
+		{"before the buffer", t0.Add(-time.Hour), 0},
+		{"at a key frame", at(10), 10},
+		{"between key frames", at(19), 10},
+		{"just before a key frame", at(20).Add(-time.Millisecond), 10},
+		{"after the latest key frame", at(34), 30},
+		{"in the future", t0.Add(time.Hour), 30},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			seq, ok := b.KeyFrameBefore(ca.t)
+			if !ok || seq != ca.want {
+				t.Errorf("expected %d, got %d (%v)", ca.want, seq, ok)
+			}
+		})
+	}
+}
+
+func TestKeyFrameBeforeAfterEviction(t *testing.T) {
+	b := New(time.Second)
+	fill(b, 30)
+
+	// key frame 10 has been evicted, the oldest one left is 20
+	seq, ok := b.KeyFrameBefore(at(15))
+	if !ok || seq != 20 {
+		t.Errorf("expected 20, got %d (%v)", seq, ok)
+	}
+}
+
+func TestLatestKeyFrame(t *testing.T) {
+	b := New(5 * time.Second)
+	if _, ok := b.LatestKeyFrame(); ok {
+		t.Error("expected no key frame in an empty buffer")
+	}
+
+	fill(b, 25)
+	seq, ok := b.LatestKeyFrame()
+	if !ok || seq != 20 {
+		t.Errorf("expected 20, got %d (%v)", seq, ok)
+	}
+}
+
+func TestRange(t *testing.T) {
+	b := New(5 * time.Second)
+	if b.Range(t0, t0.Add(time.Hour)) != nil {
+		t.Error("expected no entries in an empty buffer")
+	}
+
+	fill(b, 35)
+
+	for _, ca := range []struct {
+		name  string
+		start time.Time
+		end   time.Time
+		first int
+		last  int
+	}{
+		{"from a key frame", at(10), at(15), 10, 15},
+		{"from the preceding key frame", at(13), at(25), 10, 25},
+		{"until the end", at(22), t0.Add(time.Hour), 20, 34},
+		{"before the buffer", t0.Add(-time.Hour), at(3), 0, 3},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			entries := b.Range(ca.start, ca.end)
+			if len(entries) != ca.last-ca.first+1 {
+				t.Fatalf("expected %d entries, got %d", ca.last-ca.first+1, len(entries))
+			}
+			if !entries[0].KeyFrame {
+				t.Error("expected the range to begin with a key frame")
+			}
+			if !entries[0].NTP.Equal(at(ca.first)) || !entries[len(entries)-1].NTP.Equal(at(ca.last)) {
+				t.Errorf("expected entries %d to %d, got %v to %v",
+					ca.first, ca.last, entries[0].NTP, entries[len(entries)-1].NTP)
+			}
+		})
+	}
+}
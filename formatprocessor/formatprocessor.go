@@ -6,6 +6,7 @@ import (
 
 	"bytes"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/bluenviron/gortsplib/v4/pkg/rtptime"
@@ -13,8 +14,11 @@ import (
 	"github.com/bluenviron/gortsplib/v4/pkg/format"
 	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
 	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph265"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtpsimpleaudio"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtpvp8"
 	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
 	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/bluenviron/mediacommon/pkg/codecs/opus"
 	"github.com/pion/rtp"
 
 	"github.com/nicksanford/rtspwebrtcbridge/unit"
@@ -32,6 +36,12 @@ func New(
 	case *format.H265:
 		return newH265(udpMaxPayloadSize, forma, generateRTPPackets)
 
+	case *format.VP8:
+		return newVP8(udpMaxPayloadSize, forma, generateRTPPackets)
+
+	case *format.Opus:
+		return newOpus(udpMaxPayloadSize, forma, generateRTPPackets)
+
 	default:
 		return nil, errors.New("Unsupported formatprocessor")
 	}
@@ -713,3 +723,210 @@ func (t *formatProcessorH265) ProcessRTPPacket( //nolint:dupl
 
 	return u, nil
 }
+
+// vp8
+type formatProcessorVP8 struct {
+	udpMaxPayloadSize int
+	format            *format.VP8
+	encoder           *rtpvp8.Encoder
+	decoder           *rtpvp8.Decoder
+}
+
+func newVP8(
+	udpMaxPayloadSize int,
+	forma *format.VP8,
+	generateRTPPackets bool,
+) (*formatProcessorVP8, error) {
+	t := &formatProcessorVP8{
+		udpMaxPayloadSize: udpMaxPayloadSize,
+		format:            forma,
+	}
+
+	if generateRTPPackets {
+		err := t.createEncoder()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *formatProcessorVP8) createEncoder() error {
+	t.encoder = &rtpvp8.Encoder{
+		PayloadMaxSize: t.udpMaxPayloadSize - 12,
+		PayloadType:    t.format.PayloadTyp,
+	}
+	return t.encoder.Init()
+}
+
+func (t *formatProcessorVP8) ProcessUnit(uu unit.Unit) error { //nolint:dupl
+	u := uu.(*unit.VP8)
+
+	pkts, err := t.encoder.Encode(u.Frame)
+	if err != nil {
+		return err
+	}
+	u.RTPPackets = pkts
+
+	ts := uint32(multiplyAndDivide(u.PTS, time.Duration(t.format.ClockRate()), time.Second))
+	for _, pkt := range u.RTPPackets {
+		pkt.Timestamp += ts
+	}
+
+	return nil
+}
+
+func (t *formatProcessorVP8) ProcessRTPPacket( //nolint:dupl
+	pkt *rtp.Packet,
+	ntp time.Time,
+	pts time.Duration,
+	hasNonRTSPReaders bool,
+) (unit.Unit, error) {
+	u := &unit.VP8{
+		Base: unit.Base{
+			RTPPackets: []*rtp.Packet{pkt},
+			NTP:        ntp,
+			PTS:        pts,
+		},
+	}
+
+	// remove padding
+	pkt.Header.Padding = false
+	pkt.PaddingSize = 0
+
+	if pkt.MarshalSize() > t.udpMaxPayloadSize {
+		return nil, fmt.Errorf("payload size (%d) is greater than maximum allowed (%d)",
+			pkt.MarshalSize(), t.udpMaxPayloadSize)
+	}
+
+	// decode from RTP
+	if hasNonRTSPReaders || t.decoder != nil {
+		if t.decoder == nil {
+			var err error
+			t.decoder, err = t.format.CreateDecoder()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		frame, err := t.decoder.Decode(pkt)
+		if err != nil {
+			if errors.Is(err, rtpvp8.ErrNonStartingPacketAndNoPrevious) ||
+				errors.Is(err, rtpvp8.ErrMorePacketsNeeded) {
+				return u, nil
+			}
+			return nil, err
+		}
+
+		u.Frame = frame
+	}
+
+	// route packet as is
+	return u, nil
+}
+
+// opus
+type formatProcessorOpus struct {
+	udpMaxPayloadSize int
+	format            *format.Opus
+	encoder           *rtpsimpleaudio.Encoder
+	decoder           *rtpsimpleaudio.Decoder
+}
+
+func newOpus(
+	udpMaxPayloadSize int,
+	forma *format.Opus,
+	generateRTPPackets bool,
+) (*formatProcessorOpus, error) {
+	t := &formatProcessorOpus{
+		udpMaxPayloadSize: udpMaxPayloadSize,
+		format:            forma,
+	}
+
+	if generateRTPPackets {
+		err := t.createEncoder()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *formatProcessorOpus) createEncoder() error {
+	t.encoder = &rtpsimpleaudio.Encoder{
+		PayloadMaxSize: t.udpMaxPayloadSize - 12,
+		PayloadType:    t.format.PayloadTyp,
+	}
+	return t.encoder.Init()
+}
+
+func (t *formatProcessorOpus) ProcessUnit(uu unit.Unit) error {
+	u := uu.(*unit.Opus)
+
+	var rtpPackets []*rtp.Packet //nolint:prealloc
+	pts := u.PTS
+
+	for _, packet := range u.Packets {
+		pkt, err := t.encoder.Encode(packet)
+		if err != nil {
+			return err
+		}
+
+		ts := uint32(multiplyAndDivide(pts, time.Duration(t.format.ClockRate()), time.Second))
+		pkt.Timestamp += ts
+
+		rtpPackets = append(rtpPackets, pkt)
+		pts += opus.PacketDuration(packet)
+	}
+
+	u.RTPPackets = rtpPackets
+
+	return nil
+}
+
+func (t *formatProcessorOpus) ProcessRTPPacket(
+	pkt *rtp.Packet,
+	ntp time.Time,
+	pts time.Duration,
+	hasNonRTSPReaders bool,
+) (unit.Unit, error) {
+	u := &unit.Opus{
+		Base: unit.Base{
+			RTPPackets: []*rtp.Packet{pkt},
+			NTP:        ntp,
+			PTS:        pts,
+		},
+	}
+
+	// remove padding
+	pkt.Header.Padding = false
+	pkt.PaddingSize = 0
+
+	if pkt.MarshalSize() > t.udpMaxPayloadSize {
+		return nil, fmt.Errorf("payload size (%d) is greater than maximum allowed (%d)",
+			pkt.MarshalSize(), t.udpMaxPayloadSize)
+	}
+
+	// decode from RTP
+	if hasNonRTSPReaders || t.decoder != nil {
+		if t.decoder == nil {
+			var err error
+			t.decoder, err = t.format.CreateDecoder()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		packet, err := t.decoder.Decode(pkt)
+		if err != nil {
+			return nil, err
+		}
+
+		u.Packets = [][]byte{packet}
+	}
+
+	// route packet as is
+	return u, nil
+}
@@ -0,0 +1,750 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph265"
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtpvp8"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/nicksanford/rtspwebrtcbridge/dvr"
+	"github.com/nicksanford/rtspwebrtcbridge/formatprocessor"
+	"github.com/nicksanford/rtspwebrtcbridge/unit"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	streamsMutex sync.RWMutex
+	streams      = map[string]*liveStream{}
+	// stream of viewers which don't pick one
+	defaultStreamName string
+)
+
+func addStream(s *liveStream) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	streams[s.name] = s
+}
+
+func findStream(name string) *liveStream {
+	streamsMutex.RLock()
+	defer streamsMutex.RUnlock()
+	return streams[name]
+}
+
+func defaultStream() string {
+	streamsMutex.RLock()
+	defer streamsMutex.RUnlock()
+	return defaultStreamName
+}
+
+func setDefaultStream(name string) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	defaultStreamName = name
+}
+
+// startStream creates the stream described by sc and starts pulling its source.
+func startStream(sc *streamConf, dvrWindow time.Duration) (*liveStream, error) {
+	s, err := newLiveStream(sc, dvrWindow)
+	if err != nil {
+		return nil, err
+	}
+	addStream(s)
+
+	if s.source != nil {
+		go s.source.run(s)
+	}
+	if s.sub != nil {
+		go s.sub.source.run(s.sub)
+	}
+	return s, nil
+}
+
+// removeStream stops the stream called name and disconnects its source, publisher and viewers.
+func removeStream(name string) {
+	streamsMutex.Lock()
+	s, ok := streams[name]
+	delete(streams, name)
+	streamsMutex.Unlock()
+
+	if ok {
+		s.close()
+	}
+}
+
+// liveStream is a stream made available to viewers.
+// It is fed either by pulling from a RTSP server or by a RTSP or WHIP publisher.
+type liveStream struct {
+	name     string
+	mimeType string
+	conf     *streamConf
+	// holds the codec of the video, sent to each peer through its own peerTrack
+	track *webrtc.TrackLocalStaticRTP
+	dvr   *dvr.Buffer
+
+	// nil when the stream doesn't carry audio
+	audioTrack *webrtc.TrackLocalStaticRTP
+
+	// nil when the stream doesn't accept publishers
+	publish *publishPath
+
+	// nil when the stream isn't pulled from a RTSP server
+	source *rtspSource
+
+	// stream pulling the sub source, nil when there is none
+	sub *liveStream
+
+	// per-peer tracks fed with the packets of the stream, see peerTrack
+	subscribersMutex sync.RWMutex
+	subscribers      map[*peerTrack]int
+
+	// payload bytes sent to the viewers, used to estimate the bitrate
+	bytesSent atomic.Uint64
+
+	// header of the last packet of the stream,
+	// used to keep numbering continuous when the source reconnects
+	lastSequenceNumber atomic.Uint32
+	lastTimestamp      atomic.Uint32
+
+	// arrival time of the last RTP packet of the source and of the last access unit
+	// sent to the viewers, in Unix nanoseconds
+	lastPacket atomic.Int64
+	lastAU     atomic.Int64
+
+	// serializes the writes of successive ingests, see writeVideo
+	outputMutex   sync.Mutex
+	lastOutput    time.Time
+	lastOutputPTS time.Duration
+
+	// canceled when the stream is removed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex          sync.RWMutex
+	format         format.Format
+	closePublisher func()
+
+	// WebRTC viewers, viewersChanged is closed and replaced when their number changes
+	viewers        int
+	viewersChanged chan struct{}
+
+	// set while the source is failing, stalledChanged is closed and replaced when it changes
+	stalled        bool
+	stalledChanged chan struct{}
+}
+
+// newLiveStream allocates a stream described by sc, which must be valid.
+// Streams fed by publishers may also carry Opus audio.
+func newLiveStream(sc *streamConf, dvrWindow time.Duration) (*liveStream, error) {
+	mimeType := codecLookup[sc.Codec]
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, "synced-video", "synced-video")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &liveStream{
+		name:     sc.Name,
+		mimeType: mimeType,
+		conf:     sc,
+		track:    track,
+		dvr:      dvr.New(dvrWindow),
+		ctx:      ctx,
+		cancel:   cancel,
+
+		viewersChanged: make(chan struct{}),
+		stalledChanged: make(chan struct{}),
+		subscribers:    map[*peerTrack]int{},
+	}
+
+	if sc.Source != "" {
+		s.source, err = newRTSPSource(sc.sourceConf())
+		if err != nil {
+			return nil, err
+		}
+
+		if sc.SubSource != "" {
+			// the sub stream is only watched live, its buffer stays short
+			s.sub, err = newLiveStream(sc.subStreamConf(), subStreamDVRWindow)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+
+	s.audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "synced-audio", "synced-video")
+	if err != nil {
+		return nil, err
+	}
+
+	s.publish = &publishPath{
+		name:     sc.Name,
+		mimeType: mimeType,
+		user:     sc.Auth.User,
+		pass:     sc.Auth.Pass,
+	}
+	return s, nil
+}
+
+func (s *liveStream) close() {
+	if s.sub != nil {
+		s.sub.close()
+	}
+	s.cancel()
+	s.setPublisher(nil)
+	if rtspSrv != nil {
+		rtspSrv.removeStream(s)
+	}
+}
+
+// setPublisher disconnects the current publisher, if any, in favor of a new one.
+func (s *liveStream) setPublisher(closePublisher func()) {
+	s.mutex.Lock()
+	old := s.closePublisher
+	s.closePublisher = closePublisher
+	s.mutex.Unlock()
+
+	if old != nil {
+		old()
+	}
+}
+
+// addViewer counts the viewers of the stream, which are also viewers of its sub stream.
+func (s *liveStream) addViewer(delta int) {
+	if s.sub != nil {
+		s.sub.addViewer(delta)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.viewers += delta
+	close(s.viewersChanged)
+	s.viewersChanged = make(chan struct{})
+}
+
+// subscribe feeds pt with the packets of the stream as the given layer, until unsubscribe.
+func (s *liveStream) subscribe(pt *peerTrack, layer int) {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+	s.subscribers[pt] = layer
+}
+
+func (s *liveStream) unsubscribe(pt *peerTrack) {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+	delete(s.subscribers, pt)
+}
+
+// peerStats returns the latest stats of the peers of the stream.
+func (s *liveStream) peerStats() []*peerStats {
+	s.subscribersMutex.RLock()
+	defer s.subscribersMutex.RUnlock()
+	stats := []*peerStats{}
+	for pt := range s.subscribers {
+		if ps, ok := pt.stats.Load().(*peerStats); ok {
+			stats = append(stats, ps)
+		}
+	}
+	return stats
+}
+
+func (s *liveStream) forward(packets []*rtp.Packet, keyFrame bool, disposable bool) {
+	s.subscribersMutex.RLock()
+	defer s.subscribersMutex.RUnlock()
+	for pt, layer := range s.subscribers {
+		pt.push(layer, packets, keyFrame, disposable)
+	}
+}
+
+func (s *liveStream) viewerCount() (int, <-chan struct{}) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.viewers, s.viewersChanged
+}
+
+// waitViewers blocks until there is at least a viewer, it returns false when the stream is removed.
+func (s *liveStream) waitViewers() bool {
+	for {
+		n, changed := s.viewerCount()
+		if n > 0 {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-s.ctx.Done():
+			return false
+		}
+	}
+}
+
+// waitIdle blocks until there have been no viewers for closeAfter,
+// it returns false when ctx is canceled first.
+func (s *liveStream) waitIdle(ctx context.Context, closeAfter time.Duration) bool {
+	for {
+		n, changed := s.viewerCount()
+		if n > 0 {
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		t := time.NewTimer(closeAfter)
+		select {
+		case <-changed:
+			t.Stop()
+		case <-ctx.Done():
+			t.Stop()
+			return false
+		case <-t.C:
+			return true
+		}
+	}
+}
+
+func (s *liveStream) setStalled(stalled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stalled == stalled {
+		return
+	}
+
+	s.stalled = stalled
+	close(s.stalledChanged)
+	s.stalledChanged = make(chan struct{})
+
+	if stalled {
+		log.Printf("stream '%s': stalled", s.name)
+	} else {
+		log.Printf("stream '%s': resumed", s.name)
+	}
+}
+
+func (s *liveStream) stalledState() (bool, <-chan struct{}) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.stalled, s.stalledChanged
+}
+
+// stallReason returns why the source is considered stalled after timeout, or an empty string.
+func (s *liveStream) stallReason(timeout time.Duration) string {
+	switch {
+	case time.Since(time.Unix(0, s.lastPacket.Load())) > timeout:
+		return "no RTP packets received"
+	case time.Since(time.Unix(0, s.lastAU.Load())) > timeout:
+		return "no decodable access units received"
+	default:
+		return ""
+	}
+}
+
+// currentFormat returns the format of the current source,
+// which holds the latest parameter sets.
+func (s *liveStream) currentFormat() format.Format {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.format
+}
+
+// findFormat returns the media and format of desc matching the codec of the stream.
+func (s *liveStream) findFormat(desc *description.Session) (*description.Media, format.Format, error) {
+	switch s.mimeType {
+	case webrtc.MimeTypeH264:
+		var f *format.H264
+		medi := desc.FindFormat(&f)
+		if medi == nil {
+			return nil, nil, errors.New("H264 media not found")
+		}
+		return medi, f, nil
+
+	case webrtc.MimeTypeH265:
+		var f *format.H265
+		medi := desc.FindFormat(&f)
+		if medi == nil {
+			return nil, nil, errors.New("H265 media not found")
+		}
+		return medi, f, nil
+
+	case webrtc.MimeTypeVP8:
+		var f *format.VP8
+		medi := desc.FindFormat(&f)
+		if medi == nil {
+			return nil, nil, errors.New("VP8 media not found")
+		}
+		return medi, f, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported mime type %s", s.mimeType)
+	}
+}
+
+// writeVideo sends the packets of an access unit to the viewers and stores it in the DVR buffer.
+// Disposable access units aren't used as reference by others, viewers can skip them.
+// Output starts at the first key frame of the ingest and continues the numbering and the timing
+// of the previous ingest, so that a change of source is seamless for the viewers.
+func (in *ingest) writeVideo(packets []*rtp.Packet, e *dvr.Entry, disposable bool) {
+	if len(packets) == 0 {
+		return
+	}
+
+	if !in.keyFrameReceived {
+		if !e.KeyFrame {
+			return
+		}
+		in.keyFrameReceived = true
+	}
+
+	s := in.stream
+	s.outputMutex.Lock()
+	defer s.outputMutex.Unlock()
+
+	if !in.aligned {
+		in.aligned = true
+		if !s.lastOutput.IsZero() {
+			elapsed := time.Since(s.lastOutput)
+			gap := ptsToTimestamp(elapsed)
+			if gap < discontinuityGap {
+				gap = discontinuityGap
+			}
+			in.seqOffset = uint16(s.lastSequenceNumber.Load()) + 1 - packets[0].SequenceNumber
+			in.tsOffset = s.lastTimestamp.Load() + gap - packets[0].Timestamp
+			in.ptsOffset = s.lastOutputPTS + elapsed - e.PTS
+		}
+	}
+
+	for _, pkt := range packets {
+		pkt.SequenceNumber += in.seqOffset
+		pkt.Timestamp += in.tsOffset
+		s.bytesSent.Add(uint64(len(pkt.Payload)))
+	}
+	s.forward(packets, e.KeyFrame, disposable)
+
+	last := packets[len(packets)-1]
+	s.lastSequenceNumber.Store(uint32(last.SequenceNumber))
+	s.lastTimestamp.Store(last.Timestamp)
+
+	e.PTS += in.ptsOffset
+	s.lastOutputPTS = e.PTS
+	s.lastOutput = time.Now()
+	s.dvr.Push(e)
+
+	s.lastAU.Store(s.lastOutput.UnixNano())
+	if stalled, _ := s.stalledState(); stalled {
+		s.setStalled(false)
+	}
+}
+
+// ingest routes the packets of a source to the outputs of a stream.
+// A new ingest is created every time a source connects.
+type ingest struct {
+	stream       *liveStream
+	format       format.Format
+	fp           unit.Processor
+	serverMedia  *description.Media
+	serverStream *gortsplib.ServerStream
+
+	audioFP          unit.Processor
+	serverAudioMedia *description.Media
+
+	h264Encoder   *rtph264.Encoder
+	h265Encoder   *rtph265.Encoder
+	vp8Encoder    *rtpvp8.Encoder
+	firstReceived bool
+	lastPTS       time.Duration
+
+	// offsets which continue the output of the previous ingest
+	keyFrameReceived bool
+	aligned          bool
+	seqOffset        uint16
+	tsOffset         uint32
+	ptsOffset        time.Duration
+
+	// highest H265 temporal sub-layer received, whose non-reference pictures can be dropped
+	maxTemporalID uint8
+
+	// set when the video can't be forwarded, the following packets are dropped
+	failed bool
+}
+
+// newIngest allocates an ingest for a source with the given video format and,
+// optionally, an Opus audio format.
+func (s *liveStream) newIngest(forma format.Format, audioFormat *format.Opus) (*ingest, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, errors.New("stream was removed")
+	}
+
+	fp, err := formatprocessor.New(1472, forma, true)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &ingest{
+		stream: s,
+		format: forma,
+		fp:     fp,
+		h264Encoder: &rtph264.Encoder{
+			PayloadType:    96,
+			PayloadMaxSize: webrtcPayloadMaxSize,
+		},
+		h265Encoder: &rtph265.Encoder{
+			PayloadType:    96,
+			PayloadMaxSize: webrtcPayloadMaxSize,
+		},
+		vp8Encoder: &rtpvp8.Encoder{
+			PayloadType:    96,
+			PayloadMaxSize: webrtcPayloadMaxSize,
+		},
+	}
+
+	if err := in.h264Encoder.Init(); err != nil {
+		return nil, err
+	}
+	in.h265Encoder.Init()
+	if err := in.vp8Encoder.Init(); err != nil {
+		return nil, err
+	}
+
+	if audioFormat != nil && s.audioTrack != nil {
+		in.audioFP, err = formatprocessor.New(1472, audioFormat, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// forma is updated by fp, readers receive the latest parameter sets
+	if rtspSrv != nil && s.conf.hasOutput("rtsp") {
+		in.serverMedia = &description.Media{
+			Type:    description.MediaTypeVideo,
+			Formats: []format.Format{forma},
+		}
+		medias := []*description.Media{in.serverMedia}
+
+		if in.audioFP != nil {
+			in.serverAudioMedia = &description.Media{
+				Type:    description.MediaTypeAudio,
+				Formats: []format.Format{audioFormat},
+			}
+			medias = append(medias, in.serverAudioMedia)
+		}
+
+		in.serverStream = rtspSrv.addStream(s, &description.Session{Medias: medias})
+	}
+
+	s.mutex.Lock()
+	s.format = forma
+	s.mutex.Unlock()
+
+	return in, nil
+}
+
+// processRTPPacket forwards a video packet of the source. Access units which can't be encoded are dropped,
+// an error is returned once when the video can't be forwarded at all and the source must be disconnected.
+func (in *ingest) processRTPPacket(pkt *rtp.Packet, pts time.Duration) error {
+	if in.failed {
+		return nil
+	}
+
+	ntp := time.Now()
+	u, err := in.fp.ProcessRTPPacket(pkt, ntp, pts, true)
+	if err != nil {
+		log.Println(err.Error())
+		return nil
+	}
+
+	if in.serverStream != nil {
+		for _, pkt := range u.GetRTPPackets() {
+			in.serverStream.WritePacketRTPWithNTP(in.serverMedia, pkt, ntp) //nolint:errcheck
+		}
+	}
+
+	// NOTE: In mediamtx there is a ring buffer between the goroutine which receives RTP packets from RSTP & the WebRTC publisher
+	// at this point
+	// This might be a place to improve performance by adding a similar ring buffer
+
+	switch in.format.(type) {
+	case *format.H264:
+		tunit, ok := u.(*unit.H264)
+		if !ok {
+			log.Println("u.(*unit.H264) type conversion error")
+			return nil
+		}
+
+		if tunit.AU == nil {
+			return nil
+		}
+
+		if !in.firstReceived {
+			in.firstReceived = true
+		} else if tunit.PTS < in.lastPTS {
+			in.failed = true
+			return errors.New("WebRTC doesn't support H264 streams with B-frames")
+		}
+		in.lastPTS = tunit.PTS
+		packets, err := in.h264Encoder.Encode(tunit.AU)
+		if err != nil {
+			log.Printf("H264 encode err: %s", err.Error())
+			return nil
+		}
+		for _, pkt := range packets {
+			pkt.Timestamp += tunit.RTPPackets[0].Timestamp
+		}
+
+		in.writeVideo(packets, &dvr.Entry{
+			NTP:      tunit.NTP,
+			PTS:      tunit.PTS,
+			AU:       tunit.AU,
+			KeyFrame: h264.IDRPresent(tunit.AU),
+		}, isH264Disposable(tunit.AU))
+
+	case *format.H265:
+		tunit, ok := u.(*unit.H265)
+		if !ok {
+			log.Println("u.(*unit.H265) type conversion error")
+			return nil
+		}
+
+		if tunit.AU == nil {
+			return nil
+		}
+
+		packets, err := in.h265Encoder.Encode(tunit.AU, pts)
+		if err != nil {
+			log.Printf("H265 encode err: %s", err.Error())
+			return nil
+		}
+		for _, pkt := range packets {
+			pkt.Timestamp += tunit.RTPPackets[0].Timestamp
+		}
+
+		in.writeVideo(packets, &dvr.Entry{
+			NTP:      tunit.NTP,
+			PTS:      tunit.PTS,
+			AU:       tunit.AU,
+			KeyFrame: h265.IsRandomAccess(tunit.AU),
+		}, in.isH265Disposable(tunit.AU))
+
+	case *format.VP8:
+		tunit, ok := u.(*unit.VP8)
+		if !ok {
+			log.Println("u.(*unit.VP8) type conversion error")
+			return nil
+		}
+
+		if tunit.Frame == nil {
+			return nil
+		}
+
+		packets, err := in.vp8Encoder.Encode(tunit.Frame)
+		if err != nil {
+			log.Printf("VP8 encode err: %s", err.Error())
+			return nil
+		}
+		for _, pkt := range packets {
+			pkt.Timestamp += tunit.RTPPackets[0].Timestamp
+		}
+
+		in.writeVideo(packets, &dvr.Entry{
+			NTP:      tunit.NTP,
+			PTS:      tunit.PTS,
+			AU:       [][]byte{tunit.Frame},
+			KeyFrame: isVP8KeyFrame(tunit.Frame),
+		}, false)
+
+	default:
+		in.failed = true
+		return fmt.Errorf("unsupported format %T", in.format)
+	}
+	return nil
+}
+
+func (in *ingest) processAudioRTPPacket(pkt *rtp.Packet, pts time.Duration) {
+	if in.audioFP == nil {
+		return
+	}
+
+	ntp := time.Now()
+	u, err := in.audioFP.ProcessRTPPacket(pkt, ntp, pts, false)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	for _, pkt := range u.GetRTPPackets() {
+		if in.serverStream != nil {
+			in.serverStream.WritePacketRTPWithNTP(in.serverAudioMedia, pkt, ntp) //nolint:errcheck
+		}
+		if err := in.stream.audioTrack.WriteRTP(pkt); err != nil {
+			log.Printf("WriteRTP err: %s", err.Error())
+		}
+	}
+}
+
+// isH264Disposable checks that the access unit has slices and that none of them is used as reference,
+// their nal_ref_idc is 0.
+func isH264Disposable(au [][]byte) bool {
+	slices := false
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h264.NALUType(nalu[0] & 0x1f) {
+		case h264.NALUTypeNonIDR, h264.NALUTypeDataPartitionA, h264.NALUTypeIDR:
+			if nalu[0]&0x60 != 0 {
+				return false
+			}
+			slices = true
+		}
+	}
+	return slices
+}
+
+// isH265Disposable checks that the access unit is a sub-layer non-reference picture of the highest temporal
+// sub-layer received so far, which no other picture can use as reference.
+func (in *ingest) isH265Disposable(au [][]byte) bool {
+	slices := false
+	for _, nalu := range au {
+		if len(nalu) < 2 {
+			continue
+		}
+		typ := h265.NALUType((nalu[0] >> 1) & 0x3f)
+		if typ > h265.NALUType_RSV_IRAP_VCL23 {
+			continue
+		}
+
+		if nalu[1]&0x07 == 0 {
+			return false
+		}
+		temporalID := (nalu[1] & 0x07) - 1
+		if temporalID > in.maxTemporalID {
+			in.maxTemporalID = temporalID
+		}
+		// the types of sub-layer non-reference pictures are even and below the IRAP ones
+		if typ >= h265.NALUType_BLA_W_LP || typ%2 != 0 || temporalID != in.maxTemporalID {
+			return false
+		}
+		slices = true
+	}
+	return slices
+}
+
+// isVP8KeyFrame checks the inverse key frame flag of the frame tag.
+func isVP8KeyFrame(frame []byte) bool {
+	return len(frame) > 0 && frame[0]&0x01 == 0
+}
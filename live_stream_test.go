@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+)
+
+func TestIsH264Disposable(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		au   [][]byte
+		ok   bool
+	}{
+		{"non-reference slice", [][]byte{{0x01, 0x9a}}, true},
+		{"with SEI", [][]byte{{0x06, 0x05}, {0x01, 0x9a}}, true},
+		{"with an empty NALU", [][]byte{{}, {0x01, 0x9a}}, true},
+		{"reference slice", [][]byte{{0x41, 0x9a}}, false},
+		{"low priority reference slice", [][]byte{{0x21, 0x9a}}, false},
+		{"IDR", [][]byte{{0x67, 0x42}, {0x68, 0xce}, {0x65, 0x88}}, false},
+		{"non-reference data partition", [][]byte{{0x02, 0x9a}}, true},
+		{"one reference slice", [][]byte{{0x01, 0x9a}, {0x41, 0x9a}}, false},
+		{"parameter sets only", [][]byte{{0x67, 0x42}, {0x68, 0xce}}, false},
+		{"empty", nil, false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			if ok := isH264Disposable(ca.au); ok != ca.ok {
+				t.Errorf("expected %v, got %v", ca.ok, ok)
+			}
+		})
+	}
+}
+
+// h265NALU returns a NALU header of type typ in the temporal sub-layer temporalIDPlus1 - 1.
+func h265NALU(typ h265.NALUType, temporalIDPlus1 byte) []byte {
+	return []byte{byte(typ) << 1, temporalIDPlus1, 0xaf}
+}
+
+func TestIsH265Disposable(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		// highest temporal sub-layer received before the access unit
+		maxTemporalID uint8
+		au            [][]byte
+		ok            bool
+		// highest temporal sub-layer received after it
+		wantMaxTemporalID uint8
+	}{
+		{"non-reference picture", 0, [][]byte{h265NALU(h265.NALUType_TRAIL_N, 1)}, true, 0},
+		{"reference picture", 0, [][]byte{h265NALU(h265.NALUType_TRAIL_R, 1)}, false, 0},
+		{"non-reference picture of a lower sub-layer", 1, [][]byte{h265NALU(h265.NALUType_TRAIL_N, 1)}, false, 1},
+		{"non-reference picture of the highest sub-layer", 1, [][]byte{h265NALU(h265.NALUType_TSA_N, 2)}, true, 1},
+		{"new highest sub-layer", 0, [][]byte{h265NALU(h265.NALUType_TRAIL_N, 3)}, true, 2},
+		{"reference picture of a new sub-layer", 0, [][]byte{h265NALU(h265.NALUType_TRAIL_R, 2)}, false, 1},
+		{"RASL", 0, [][]byte{h265NALU(h265.NALUType_RASL_N, 1)}, true, 0},
+		{"IDR", 0, [][]byte{h265NALU(h265.NALUType_IDR_W_RADL, 1)}, false, 0},
+		{"CRA", 0, [][]byte{h265NALU(h265.NALUType_CRA_NUT, 1)}, false, 0},
+		{"parameter sets and SEI", 0, [][]byte{
+			h265NALU(h265.NALUType_VPS_NUT, 1),
+			h265NALU(h265.NALUType_PREFIX_SEI_NUT, 1),
+			h265NALU(h265.NALUType_TRAIL_N, 1),
+		}, true, 0},
+		{"parameter sets only", 0, [][]byte{h265NALU(h265.NALUType_VPS_NUT, 1), h265NALU(h265.NALUType_SPS_NUT, 1)}, false, 0},
+		{"one reference slice", 0, [][]byte{h265NALU(h265.NALUType_TRAIL_N, 1), h265NALU(h265.NALUType_TRAIL_R, 1)}, false, 0},
+		{"invalid temporal id", 0, [][]byte{h265NALU(h265.NALUType_TRAIL_N, 0)}, false, 0},
+		{"truncated", 0, [][]byte{{byte(h265.NALUType_TRAIL_N) << 1}}, false, 0},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			in := &ingest{maxTemporalID: ca.maxTemporalID}
+			if ok := in.isH265Disposable(ca.au); ok != ca.ok {
+				t.Errorf("expected %v, got %v", ca.ok, ok)
+			}
+			if in.maxTemporalID != ca.wantMaxTemporalID {
+				t.Errorf("expected highest temporal sub-layer %d, got %d", ca.wantMaxTemporalID, in.maxTemporalID)
+			}
+		})
+	}
+}
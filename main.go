@@ -1,25 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph265"
 	"github.com/bluenviron/gortsplib/v4"
 	"github.com/bluenviron/gortsplib/v4/pkg/base"
-	"github.com/bluenviron/gortsplib/v4/pkg/description"
-	"github.com/bluenviron/gortsplib/v4/pkg/format"
-	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
 	"github.com/gorilla/websocket"
-	"github.com/nicksanford/rtspwebrtcbridge/formatprocessor"
-	"github.com/nicksanford/rtspwebrtcbridge/unit"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/rtp"
-	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v4"
 )
 
 const homeHTML = `<!DOCTYPE html>
@@ -29,317 +30,734 @@ const homeHTML = `<!DOCTYPE html>
 	</head>
 	<body id="body">
 		<video id="video1" autoplay playsinline></video>
+		<div id="status"></div>
 
 		<div>
 		  <input type="number" id="seekTime" value="30">
 		  <button type="button" onClick="seekClick()">Seek</button>
 		  <button type="button" onClick="playClick()">Play</button>
 		  <button type="button" onClick="pauseClick()">Pause</button>
+		  <button type="button" onClick="liveClick()">Live</button>
+		  <select id="layer" onChange="layerChange()">
+		    <option value="auto">Auto</option>
+		    <option value="main">Main</option>
+		    <option value="sub">Sub</option>
+		  </select>
+		  <span id="currentLayer"></span>
+		  <label><input type="checkbox" id="keyFrames" onChange="keyFramesChange()">Key frames only</label>
+		  <label><input type="number" id="frameRate" min="0" value="0" onChange="frameRateChange()">Frames per second (0 for all)</label>
 		</div>
 
 		<script>
-			let conn = new WebSocket('ws://' + window.location.host + '/ws')
-			let pc = new RTCPeerConnection()
+			let conn, pc
+
+			// the page connects again with the same stream when the websocket closes, waiting longer after each
+			// failed attempt, unless the viewer is rejected or its credentials are refused
+			let reconnectDelay = 1000
+			const maxReconnectDelay = 30000
+			// how long an ICE restart can take before the page connects again
+			const iceRestartTimeout = 10000
+
+			function connect() {
+				const ws = new WebSocket((window.location.protocol === 'https:' ? 'wss://' : 'ws://') + window.location.host + '/ws' + window.location.search)
+				const peer = new RTCPeerConnection()
+				let opened = false
+				let rejected = false
+				let restartTimer
+
+				console.log("before on track register")
+				peer.ontrack = function (event) {
+					console.log("on track", event);
+				  if (event.track.kind === 'audio') {
+					return
+				  }
+				  var el = document.getElementById('video1')
+				  el.srcObject = event.streams[0]
+				  el.autoplay = true
+				  el.controls = true
+				}
 
-			console.log("before on track register")
-			pc.ontrack = function (event) {
-				console.log("on track", event);
-			  if (event.track.kind === 'audio') {
-				return
-			  }
-			  var el = document.getElementById('video1')
-			  el.srcObject = event.streams[0]
-			  el.autoplay = true
-			  el.controls = true
-			}
+		// needed for safari to work
+				const x = peer.addTransceiver('video');
 
-	// needed for safari to work
-			const x = pc.addTransceiver('video');
-			console.log("before on open register")
-			conn.onopen = () => {
-				console.log("open");
-				pc.createOffer({offerToReceiveVideo: true, offerToReceiveAudio: true}).then(offer => {
-					console.log("got offer", offer.sdp);
-					pc.setLocalDescription(offer)
-					conn.send(JSON.stringify({event: 'offer', data: JSON.stringify(offer)}))
-				})
-			}
-			console.log("before on close register")
-			conn.onclose = evt => {
-				console.log("close");
-				console.log('Connection closed')
-			}
-			console.log("before on message register")
-			conn.onmessage = evt => {
-				console.log("message"), evt;
-				let msg = JSON.parse(evt.data)
-				if (!msg) {
-					return console.log('failed to parse msg')
+				// after a change of network the media path is negotiated again, on the same websocket
+				function restartIce() {
+					if (restartTimer !== undefined || ws.readyState !== WebSocket.OPEN) {
+						return
+					}
+					document.getElementById('status').textContent = 'Connection lost, restarting...'
+					restartTimer = setTimeout(() => ws.close(), iceRestartTimeout)
+					peer.createOffer({iceRestart: true}).then(offer => {
+						peer.setLocalDescription(offer)
+						ws.send(JSON.stringify({event: 'ice-restart', data: JSON.stringify(offer)}))
+					})
+				}
+				peer.oniceconnectionstatechange = () => {
+					console.log("ice connection state", peer.iceConnectionState)
+					switch (peer.iceConnectionState) {
+					case 'disconnected':
+					case 'failed':
+						restartIce()
+						return
+					case 'connected':
+					case 'completed':
+						if (restartTimer !== undefined) {
+							clearTimeout(restartTimer)
+							restartTimer = undefined
+							document.getElementById('status').textContent = ''
+						}
+						reconnectDelay = 1000
+						return
+					}
 				}
 
-				switch (msg.event) {
-				case 'answer':
-					answer = JSON.parse(msg.data)
-					if (!answer) {
-						return console.log('failed to parse answer')
+				console.log("before on open register")
+				ws.onopen = () => {
+					console.log("open");
+					opened = true
+					document.getElementById('status').textContent = ''
+					peer.createOffer({offerToReceiveVideo: true, offerToReceiveAudio: true}).then(offer => {
+						console.log("got offer", offer.sdp);
+						peer.setLocalDescription(offer)
+						ws.send(JSON.stringify({event: 'offer', data: JSON.stringify(offer)}))
+
+						// a new session keeps the choices made in the previous one
+						if (document.getElementById('layer').value !== 'auto') {
+							layerChange()
+						}
+						keyFramesChange()
+						frameRateChange()
+					})
+				}
+				console.log("before on close register")
+				ws.onclose = evt => {
+					console.log("close");
+					console.log('Connection closed')
+					clearTimeout(restartTimer)
+					peer.close()
+					if (rejected) {
+						return
+					}
+					if (opened) {
+						reconnect()
+						return
+					}
+					// browsers don't tell why a handshake failed, the same request without the upgrade does
+					fetch('/ws' + window.location.search).then(res => {
+						if (res.status === 401 || res.status === 403) {
+							document.getElementById('status').textContent = 'Access denied'
+							return
+						}
+						reconnect()
+					}, reconnect)
+				}
+				console.log("before on message register")
+				ws.onmessage = evt => {
+					console.log("message"), evt;
+					let msg = JSON.parse(evt.data)
+					if (!msg) {
+						return console.log('failed to parse msg')
+					}
+
+					switch (msg.event) {
+					case 'answer':
+						answer = JSON.parse(msg.data)
+						if (!answer) {
+							return console.log('failed to parse answer')
+						}
+						peer.setRemoteDescription(answer)
+						return console.log('processed answer')
+					case 'ice-restart':
+						restartIce()
+						return
+					case 'stalled':
+						document.getElementById('status').textContent = 'The source stalled, reconnecting...'
+						return
+					case 'resumed':
+						document.getElementById('status').textContent = ''
+						return
+					case 'layer':
+						document.getElementById('currentLayer').textContent = msg.data
+						return
+					case 'rejected':
+						rejected = true
+						document.getElementById('status').textContent = 'Rejected: ' + msg.data
+						return
 					}
-					pc.setRemoteDescription(answer)
-					return console.log('processed answer')
 				}
+
+				conn = ws
+				pc = peer
+				window.conn = conn
+			}
+
+			function reconnect() {
+				document.getElementById('status').textContent = 'Disconnected, reconnecting...'
+				setTimeout(connect, reconnectDelay)
+				reconnectDelay = Math.min(reconnectDelay * 2, maxReconnectDelay)
+			}
+
+			// seekTime is the number of seconds to rewind from live
+			function seekClick() {
+				conn.send(JSON.stringify({event: 'seek', data: document.getElementById('seekTime').value}))
+			}
+			function playClick() {
+				conn.send(JSON.stringify({event: 'play', data: ''}))
+			}
+			function pauseClick() {
+				conn.send(JSON.stringify({event: 'pause', data: ''}))
+			}
+			function liveClick() {
+				conn.send(JSON.stringify({event: 'live', data: ''}))
+			}
+			// the layer only applies to streams with a sub stream
+			function layerChange() {
+				conn.send(JSON.stringify({event: 'layer', data: document.getElementById('layer').value}))
+			}
+			// a slideshow of the key frames, for viewers with little bandwidth
+			document.getElementById('keyFrames').checked = new URLSearchParams(window.location.search).get('keyframes') === '1'
+			function keyFramesChange() {
+				conn.send(JSON.stringify({event: 'keyframes', data: document.getElementById('keyFrames').checked ? 'on' : 'off'}))
 			}
-			window.conn = conn
+			// fewer frames per second, for viewers with little bandwidth or CPU
+			document.getElementById('frameRate').value = new URLSearchParams(window.location.search).get('fps') || 0
+			function frameRateChange() {
+				conn.send(JSON.stringify({event: 'framerate', data: document.getElementById('frameRate').value}))
+			}
+
+			connect()
 		</script>
 	</body>
 </html>
 `
 
-var mimeLookup = map[string]string{"4": webrtc.MimeTypeH264, "5": webrtc.MimeTypeH265}
-
 var (
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		CheckOrigin:     checkWebsocketOrigin,
 	}
 	peerConnectionConfig = webrtc.Configuration{}
-	videoTrackRTP        = &webrtc.TrackLocalStaticRTP{}
+	settingEngine        webrtc.SettingEngine
+	clipsDir             string
+	rtspSrv              *rtspServer
 )
 
+const webrtcPayloadMaxSize = 1188 // 1200 - 12 (RTP header)
+
+// time given to a viewer whose connection was lost to restart ICE, after which it is disconnected
+const iceRestartTimeout = 30 * time.Second
+
+// peer is the state of a single WebRTC viewer.
+type peer struct {
+	stream     *liveStream
+	pc         *webrtc.PeerConnection
+	ws         *websocket.Conn
+	sender     *webrtc.RTPSender
+	remoteAddr string
+
+	ctx    context.Context
+	replay *replayer
+
+	track *peerTrack
+	// auto, main or sub
+	layerMode atomic.Value
+	// set when the viewer asked for the key frames only
+	keyFramesOnly atomic.Bool
+	// frames per second the viewer asked for, 0 for all of them
+	maxFrameRate atomic.Int32
+	// congestion controller fed by the TWCC feedback of the viewer, nil when it isn't negotiated
+	bwe cc.BandwidthEstimator
+	// latest REMB of the viewer in bits per second, 0 when unknown
+	remb atomic.Uint64
+
+	recovery *recoveryCounter
+	// packets the viewer reported lost and asked again
+	nacked atomic.Uint64
+
+	// websocket writes come from the message loop and from notifications
+	wsMutex sync.Mutex
+}
+
+func (p *peer) writeMessage(message *websocketMessage) error {
+	p.wsMutex.Lock()
+	defer p.wsMutex.Unlock()
+	return p.ws.WriteJSON(message)
+}
+
+// notifyStalled tells the viewer when the source of the stream stalls and resumes.
+func (p *peer) notifyStalled() {
+	notified := false
+	for {
+		stalled, changed := p.stream.stalledState()
+		if stalled != notified {
+			event := "resumed"
+			if stalled {
+				event = "stalled"
+			}
+			if err := p.writeMessage(&websocketMessage{Event: event}); err != nil {
+				return
+			}
+			notified = stalled
+		}
+
+		select {
+		case <-changed:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// superviseConnection follows the state of the peer connection. When it is lost the page is asked to restart ICE,
+// which it also does by itself, and the viewer is disconnected if it isn't connected again within iceRestartTimeout.
+func (p *peer) superviseConnection(changed <-chan struct{}) {
+	var timeout <-chan time.Time
+	for {
+		select {
+		// handlers run in their own goroutines, the state is read again so that their order doesn't matter
+		case <-changed:
+			state := p.pc.ConnectionState()
+			log.Printf("viewer %s of '%s': connection %s", p.remoteAddr, p.stream.name, state)
+			switch state {
+			case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+				if timeout == nil {
+					timeout = time.After(iceRestartTimeout)
+				}
+				if err := p.writeMessage(&websocketMessage{Event: "ice-restart"}); err != nil {
+					return
+				}
+
+			case webrtc.PeerConnectionStateConnected:
+				timeout = nil
+
+			case webrtc.PeerConnectionStateClosed:
+				p.ws.Close()
+				return
+			}
+
+		case <-timeout:
+			log.Printf("viewer %s of '%s': connection not restored after %s", p.remoteAddr, p.stream.name, iceRestartTimeout)
+			p.ws.Close()
+			return
+
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
 type websocketMessage struct {
 	Event string `json:"event"`
 	Data  string `json:"data"`
 }
 
-func main() {
-	if len(os.Args) != 3 {
-		log.Fatalf("usage %s <rtsp server url> <4|5>", os.Args[0])
+// publishPath is a path which accepts RTSP and WHIP publishers.
+type publishPath struct {
+	name     string
+	mimeType string
+	user     string
+	pass     string
+}
+
+// codecArgs maps the codec arguments of the command line to the codecs of the configuration.
+var codecArgs = map[string]string{"4": "h264", "5": "h265", "vp8": "vp8"}
+
+// publishFlags are streams fed by publishers, in the form path:<4|5|vp8>[:user:pass].
+type publishFlags []*streamConf
+
+func (p *publishFlags) String() string {
+	return fmt.Sprint(*p)
+}
+
+func (p *publishFlags) Set(v string) error {
+	parts := strings.Split(v, ":")
+	if len(parts) != 2 && len(parts) != 4 {
+		return fmt.Errorf("invalid publish path '%s', expected path:<4|5|vp8>[:user:pass]", v)
+	}
+
+	codec, ok := codecArgs[parts[1]]
+	if !ok {
+		return fmt.Errorf("invalid codec '%s', expected 4, 5 or vp8", parts[1])
 	}
 
-	if os.Args[2] != "4" && os.Args[2] != "5" {
-		log.Fatalf("usage %s <rtsp server url> <4|5>", os.Args[0])
+	sc := &streamConf{Name: parts[0], Codec: codec}
+	if len(parts) == 4 {
+		sc.Auth.User = parts[2]
+		sc.Auth.Pass = parts[3]
 	}
+	*p = append(*p, sc)
+	return nil
+}
+
+// stringsFlag is a flag which can be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
 
-	httpListenAddress := ""
-	flag.StringVar(&httpListenAddress, "http-listen-address", ":8080", "address for HTTP server to listen on")
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// usersFlag is a repeatable flag in the form user:pass.
+type usersFlag []authConf
+
+func (f *usersFlag) String() string {
+	return fmt.Sprint(len(*f), " users")
+}
+
+func (f *usersFlag) Set(v string) error {
+	user, pass, ok := strings.Cut(v, ":")
+	if !ok || user == "" {
+		return fmt.Errorf("invalid user '%s', expected user:pass", v)
+	}
+	*f = append(*f, authConf{User: user, Pass: pass})
+	return nil
+}
+
+func main() {
+	c := defaultConf()
+	confPath := ""
+	flag.StringVar(&confPath, "config", "", "YAML configuration file, which can't be combined with the other flags and the arguments")
+	flag.StringVar(&c.HTTPListenAddress, "http-listen-address", c.HTTPListenAddress, "address for HTTP server to listen on")
+	flag.StringVar(&c.TLS.CertFile, "tls-cert-file", "", "certificate serving HTTPS and WSS, reloaded when it changes")
+	flag.StringVar(&c.TLS.KeyFile, "tls-key-file", "", "key of -tls-cert-file")
+	flag.BoolVar(&c.LossRecovery.RTX, "viewer-rtx", false, "retransmit the video packets lost by viewers on a separate RTX stream")
+	flag.IntVar(&c.LossRecovery.FECPackets, "viewer-fec-packets", 0, "FlexFEC packets sent to viewers for every -viewer-fec-group video packets, 0 to disable FEC")
+	flag.IntVar(&c.LossRecovery.FECGroup, "viewer-fec-group", c.LossRecovery.FECGroup, "number of video packets protected together by -viewer-fec-packets")
+	flag.DurationVar(&c.DVRWindow, "dvr-window", c.DVRWindow, "how much of the live stream is kept in memory for rewinding")
+	flag.IntVar(&c.MaxViewers, "max-viewers", 0, "maximum number of WebRTC viewers of all streams, 0 for unlimited")
+	flag.IntVar(&c.MaxViewersPerIP, "max-viewers-per-ip", 0, "maximum number of WebRTC viewers from the same address, 0 for unlimited")
+	flag.Var((*stringsFlag)(&c.AllowedOrigins), "allowed-origin", "origin, or glob pattern of origins, whose pages can use the websocket and the HTTP endpoints, can be repeated")
+	flag.Var((*stringsFlag)(&c.ViewerAuth.Tokens), "viewer-token", "bearer token granting access to all streams, can be repeated")
+	flag.Var((*usersFlag)(&c.ViewerAuth.Users), "viewer-user", "user:pass granting access to all streams with HTTP basic authentication, can be repeated")
+	flag.StringVar(&c.ViewerAuth.URLSigningKey, "viewer-url-signing-key", "", "key of the HMAC-signed expiring URLs granting access to a stream")
+	flag.StringVar(&c.ViewerAuth.JWTKeySetFile, "viewer-jwt-key-set-file", "", "JWK set file verifying the HS256 and RS256 JWTs granting access to the streams of their streams claim")
+	flag.Var((*stringsFlag)(&c.AdminAuth.Tokens), "admin-token", "bearer token granting access to the endpoints managing the streams, can be repeated")
+	flag.Var((*usersFlag)(&c.AdminAuth.Users), "admin-user", "user:pass granting access to the endpoints managing the streams with HTTP basic authentication, can be repeated")
+	streamName := ""
+	flag.StringVar(&streamName, "stream-name", "default", "name of the pulled stream")
+	flag.StringVar(&c.ClipsDir, "clips-dir", c.ClipsDir, "directory where exported clips are stored")
+	flag.StringVar(&c.RTSPListenAddress, "rtsp-listen-address", c.RTSPListenAddress, "address for the RTSP server republishing the streams to listen on, empty to disable")
+	flag.StringVar(&c.RTSPUDPRTPAddress, "rtsp-udp-rtp-address", c.RTSPUDPRTPAddress, "UDP address of the RTSP server for RTP packets, empty to allow TCP only")
+	flag.StringVar(&c.RTSPUDPRTCPAddress, "rtsp-udp-rtcp-address", c.RTSPUDPRTCPAddress, "UDP address of the RTSP server for RTCP packets, empty to allow TCP only")
+	pulled := &streamConf{}
+	flag.StringVar(&pulled.Transport, "rtsp-transport", "auto", "transport used to pull the stream: auto, udp, multicast or tcp")
+	flag.DurationVar(&pulled.ReadTimeout, "rtsp-read-timeout", 10*time.Second, "timeout of read operations on the pulled stream")
+	flag.DurationVar(&pulled.WriteTimeout, "rtsp-write-timeout", 10*time.Second, "timeout of write operations on the pulled stream")
+	flag.DurationVar(&pulled.StallTimeout, "rtsp-stall-timeout", defaultStallTimeout, "reconnect when the pulled stream sends no packets or no decodable frames for this long")
+	flag.BoolVar(&pulled.AnyPort, "rtsp-any-port", false, "accept UDP packets of the pulled stream from any port, for servers announcing wrong ports")
+	flag.StringVar(&pulled.SourceTLS.CAFile, "rtsp-ca-file", "", "PEM file with the CAs trusted to verify rtsps:// servers")
+	flag.StringVar(&pulled.SourceTLS.Fingerprint, "rtsp-fingerprint", "", "SHA256 fingerprint of the certificate of the rtsps:// server, instead of verifying its chain")
+	flag.BoolVar(&pulled.SourceTLS.Insecure, "rtsp-insecure", false, "don't verify the certificate of the rtsps:// server")
+	flag.BoolVar(&pulled.OnDemand, "rtsp-on-demand", false, "pull the stream only while there are WebRTC viewers")
+	flag.DurationVar(&pulled.OnDemandCloseAfter, "rtsp-on-demand-close-after", defaultOnDemandCloseAfter, "how long the stream is pulled after the last viewer left, with -rtsp-on-demand")
+	flag.StringVar(&pulled.SubSource, "rtsp-sub-source", "", "URL of a lower resolution rendition of the stream, watched by viewers with little bandwidth")
+	flag.Var((*stringsFlag)(&pulled.BackupSources), "rtsp-backup-source", "URL pulled when the stream fails or stalls, can be repeated to try several URLs in order")
+	var publish publishFlags
+	flag.Var(&publish, "publish", "path:<4|5|vp8>[:user:pass] accepting RTSP and WHIP publishers, can be repeated")
 	flag.Parse()
 
-	mimeType := mimeLookup[os.Args[2]]
+	if confPath != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name != "config" {
+				log.Fatalf("-%s can't be combined with -config", f.Name)
+			}
+		})
+		if flag.NArg() != 0 {
+			log.Fatal("arguments can't be combined with -config")
+		}
+
+		var err error
+		c, err = loadConf(confPath)
+		reloadPath = confPath
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if flag.NArg() != 2 && (flag.NArg() != 0 || len(publish) == 0) {
+			log.Fatalf("usage %s [flags] <rtsp server url> <4|5|vp8>", os.Args[0])
+		}
+
+		if flag.NArg() == 2 {
+			codec, ok := codecArgs[flag.Arg(1)]
+			if !ok {
+				log.Fatalf("usage %s [flags] <rtsp server url> <4|5|vp8>", os.Args[0])
+			}
+
+			pulled.Name = streamName
+			pulled.Source = flag.Arg(0)
+			pulled.Codec = codec
+			c.Streams = append(c.Streams, pulled)
+		}
+		c.Streams = append(c.Streams, publish...)
+
+		if err := c.validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	run(c)
+}
+
+// run starts the servers and the streams of c.
+func run(c *conf) {
+	clipsDir = c.ClipsDir
+	if err := os.MkdirAll(clipsDir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+
 	var err error
-	videoTrackRTP, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, "synced-video", "synced-video")
+	peerConnectionConfig.ICEServers = c.ICE.iceServers()
+	settingEngine, err = c.ICE.settingEngine()
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println(videoTrackRTP.Codec())
-
-	c := gortsplib.Client{}
-
-	// parse URL
-	u, err := base.ParseURL(os.Args[1])
+	allowedOrigins = c.AllowedOrigins
+	limits = viewerLimits{total: c.MaxViewers, perIP: c.MaxViewersPerIP}
+	lossRecovery = c.LossRecovery
+	viewerAuthenticators, err = newViewerAuthenticators(&c.ViewerAuth)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
+	adminAuthenticators = newAdminAuthenticators(&c.AdminAuth)
 
-	// connect to the server
-	err = c.Start(u.Scheme, u.Host)
-	if err != nil {
-		panic(err)
+	if c.RTSPListenAddress != "" {
+		rtspSrv, err = newRTSPServer(c.RTSPListenAddress, c.RTSPUDPRTPAddress, c.RTSPUDPRTCPAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	scheme := "http"
+	if c.TLS.CertFile != "" {
+		scheme = "https"
 	}
 
-	defer c.Close()
+	for _, sc := range c.Streams {
+		s, err := startStream(sc, c.DVRWindow)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println(s.track.Codec())
 
-	go stream(&c, u, mimeType)
+		if s.source == nil {
+			if rtspSrv != nil {
+				fmt.Printf("accepting publishers on 'rtsp://%s/%s'\n", c.RTSPListenAddress, s.name)
+			}
+			fmt.Printf("accepting publishers on '%s://%s/whip/%s'\n", scheme, c.HTTPListenAddress, s.name)
+		}
+	}
+
+	setDefaultStream(c.Streams[0].Name)
+	currentConf = c
+	go reloadOnSIGHUP()
 
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/ws", serveWs)
+	http.HandleFunc("/api/streams", serveStreamAPI)
+	http.HandleFunc("/api/streams/", serveStreamAPI)
+	http.HandleFunc("/api/reload", withAdminAuth(serveReload))
+	http.HandleFunc("/whip/", withCORS(serveWHIP))
+	http.HandleFunc("/clips/", withCORS(serveClipFile))
+
+	fmt.Printf("streaming on '%s', have fun! \n", c.HTTPListenAddress)
+	if c.TLS.CertFile != "" {
+		certs, err := newCertReloader(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go certs.watch()
 
-	fmt.Printf("streaming on '%s', have fun! \n", httpListenAddress)
-	log.Fatal(http.ListenAndServe(httpListenAddress, nil))
+		srv := &http.Server{
+			Addr:      c.HTTPListenAddress,
+			TLSConfig: &tls.Config{GetCertificate: certs.getCertificate},
+		}
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(http.ListenAndServe(c.HTTPListenAddress, nil))
 }
 
-func stream(c *gortsplib.Client, u *base.URL, mimeType string) {
+func stream(c *gortsplib.Client, u *base.URL, s *liveStream) error {
 	// find available medias
 	desc, _, err := c.Describe(u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	var forma format.Format
-	var medi *description.Media
-	if mimeType == webrtc.MimeTypeH264 {
-		var f *format.H264
-		medi = desc.FindFormat(&f)
-		if medi == nil {
-			panic("media not found")
-		}
-		forma = f
-	} else if mimeType == webrtc.MimeTypeH265 {
-		var f *format.H265
-		medi = desc.FindFormat(&f)
-		if medi == nil {
-			panic("media not found")
-		}
-		forma = f
-	} else {
-		panic("provide media type")
+	medi, forma, err := s.findFormat(desc)
+	if err != nil {
+		return err
 	}
 
 	// setup a single media
 	_, err = c.Setup(desc.BaseURL, medi, 0, 0)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	fp, err := formatprocessor.New(1472, forma, true)
+	in, err := s.newIngest(forma, nil)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	firstReceived := false
-	var lastPTS time.Duration
-	webrtcPayloadMaxSize := 1188 // 1200 - 12 (RTP header)
-
-	h264Encoder := &rtph264.Encoder{
-		PayloadType:    96,
-		PayloadMaxSize: webrtcPayloadMaxSize,
+		return err
 	}
-
-	if err := h264Encoder.Init(); err != nil {
-		log.Fatal(err)
-	}
-
-	h265Encoder := &rtph265.Encoder{
-		PayloadType:    96,
-		PayloadMaxSize: webrtcPayloadMaxSize,
+	if in.serverStream != nil {
+		fmt.Printf("republishing on 'rtsp://%s/%s'\n", rtspSrv.server.RTSPAddress, s.name)
 	}
 
-	h265Encoder.Init()
-	// if mimeType == "video/h264" {
-	// } else if mimeType == "video/h265" {
-	// } else {
-	// 	panic("provide media type")
-	// }
-
 	c.OnPacketRTP(medi, forma, func(pkt *rtp.Packet) {
+		s.lastPacket.Store(time.Now().UnixNano())
+
 		pts, ok := c.PacketPTS(medi, pkt)
 		if !ok {
 			return
 		}
-		ntp := time.Now()
-		u, err := fp.ProcessRTPPacket(pkt, ntp, pts, false)
-		if err != nil {
-			log.Println(err.Error())
-			return
+		if err := in.processRTPPacket(pkt, pts); err != nil {
+			log.Printf("rtsp source '%s': %s", redactURL(u.String()), err.Error())
+			// Close waits for this callback to return
+			go c.Close()
 		}
+	})
 
-		// NOTE: In mediamtx there is a ring buffer between the goroutine which receives RTP packets from RSTP & the WebRTC publisher
-		// at this point
-		// This might be a place to improve performance by adding a similar ring buffer
+	// start playing
+	_, err = c.Play(nil)
+	if err != nil {
+		return err
+	}
 
-		switch forma.(type) {
-		case *format.H264:
-			tunit, ok := u.(*unit.H264)
-			if !ok {
-				log.Println("u.(*unit.H264) type conversion error")
-				return
-			}
+	// wait until a fatal error
+	return c.Wait()
+}
 
-			if tunit.AU == nil {
-				return
-			}
+// startReplay moves the peer from its live track to a track fed by the DVR buffer.
+func (p *peer) startReplay() error {
+	if p.replay != nil {
+		return nil
+	}
 
-			if !firstReceived {
-				firstReceived = true
-			} else if tunit.PTS < lastPTS {
-				log.Fatal("WebRTC doesn't support H264 streams with B-frames")
-			}
-			lastPTS = tunit.PTS
-			packets, err := h264Encoder.Encode(tunit.AU)
-			if err != nil {
-				panic(err.Error())
-			}
-			for _, pkt := range packets {
-				pkt.Timestamp += tunit.RTPPackets[0].Timestamp
-				if err := videoTrackRTP.WriteRTP(pkt); err != nil {
-					log.Printf("WriteRTP err: %s", err.Error())
-				}
-			}
+	lastSequenceNumber, lastTimestamp := p.track.last()
 
-		case *format.H265:
-			tunit, ok := u.(*unit.H265)
-			if !ok {
-				log.Println("u.(*unit.H265) type conversion error")
-				return
-			}
+	r, err := newReplayer(p.stream.dvr, p.stream.track.Codec(), lastSequenceNumber, lastTimestamp)
+	if err != nil {
+		return err
+	}
 
-			if tunit.AU == nil {
-				return
-			}
+	if err := p.sender.ReplaceTrack(r.track); err != nil {
+		return err
+	}
 
-			packets, err := h265Encoder.Encode(tunit.AU, pts)
-			if err != nil {
-				panic(err.Error())
-			}
+	p.replay = r
+	go r.run(p.ctx)
+	return nil
+}
 
-			for _, pkt := range packets {
-				pkt.Timestamp += tunit.RTPPackets[0].Timestamp
-				if err := videoTrackRTP.WriteRTP(pkt); err != nil {
-					log.Printf("WriteRTP err: %s", err.Error())
-				}
-			}
+// negotiate answers an offer of the page, the first one or one restarting ICE.
+func (p *peer) negotiate(data string) error {
+	offer := webrtc.SessionDescription{}
+	if err := json.Unmarshal([]byte(data), &offer); err != nil {
+		return err
+	}
 
-		default:
-			panic("unsupported type")
-		}
+	if err := p.pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
 
-	})
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
 
-	// start playing
-	_, err = c.Play(nil)
+	gatherComplete := webrtc.GatheringCompletePromise(p.pc)
+
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	<-gatherComplete
+
+	answerString, err := json.Marshal(p.pc.LocalDescription())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	// wait until a fatal error
-	panic(c.Wait())
+	return p.writeMessage(&websocketMessage{
+		Event: "answer",
+		Data:  string(answerString),
+	})
 }
 
-func handleWebsocketMessage(pc *webrtc.PeerConnection, ws *websocket.Conn, message *websocketMessage) error {
+func handleWebsocketMessage(p *peer, message *websocketMessage) error {
 	switch message.Event {
 	case "offer":
-		offer := webrtc.SessionDescription{}
-		if err := json.Unmarshal([]byte(message.Data), &offer); err != nil {
-			panic(err)
+		if err := p.negotiate(message.Data); err != nil {
+			return err
 		}
-		fmt.Println(message.Data)
-		fmt.Println(offer)
 
-		if err := pc.SetRemoteDescription(offer); err != nil {
-			panic(err)
+	// the network of the viewer changed, the new offer carries new ICE credentials
+	case "ice-restart":
+		log.Printf("viewer %s of '%s': restarting ICE", p.remoteAddr, p.stream.name)
+		if err := p.negotiate(message.Data); err != nil {
+			return err
 		}
 
-		answer, err := pc.CreateAnswer(nil)
-		if err != nil {
-			panic(err)
+	case "seek":
+		seconds, err := strconv.ParseFloat(message.Data, 64)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid seek offset '%s'", message.Data)
 		}
 
-		gatherComplete := webrtc.GatheringCompletePromise(pc)
+		if err := p.startReplay(); err != nil {
+			return err
+		}
+		p.replay.seek(p.ctx, time.Now().Add(-time.Duration(seconds*float64(time.Second))))
 
-		if err := pc.SetLocalDescription(answer); err != nil {
-			panic(err)
+	case "pause":
+		if p.replay == nil {
+			if err := p.startReplay(); err != nil {
+				return err
+			}
+			p.replay.seek(p.ctx, time.Now())
 		}
+		p.replay.pause(p.ctx)
 
-		<-gatherComplete
+	case "play":
+		if p.replay != nil {
+			p.replay.play(p.ctx)
+		}
 
-		answerString, err := json.Marshal(pc.LocalDescription())
-		if err != nil {
-			panic(err)
+	case "live":
+		if p.replay != nil {
+			p.replay.live(p.ctx)
 		}
 
-		if err = ws.WriteJSON(&websocketMessage{
-			Event: "answer",
-			Data:  string(answerString),
-		}); err != nil {
-			return err
+	case "layer":
+		if p.stream.sub == nil {
+			return fmt.Errorf("stream '%s' has no sub stream", p.stream.name)
+		}
+		switch message.Data {
+		case "auto", "main", "sub":
+			p.layerMode.Store(message.Data)
+		default:
+			return fmt.Errorf("invalid layer '%s', expected auto, main or sub", message.Data)
 		}
+
+	case "keyframes":
+		switch message.Data {
+		case "on", "off":
+			p.keyFramesOnly.Store(message.Data == "on")
+		default:
+			return fmt.Errorf("invalid keyframes '%s', expected on or off", message.Data)
+		}
+
+	case "framerate":
+		frameRate, err := strconv.Atoi(message.Data)
+		if err != nil || frameRate < 0 || frameRate > maxViewerFrameRate {
+			return fmt.Errorf("invalid framerate '%s', expected 0 to %d", message.Data, maxViewerFrameRate)
+		}
+		p.maxFrameRate.Store(int32(frameRate))
+
 	default:
 
 	}
@@ -347,44 +765,154 @@ func handleWebsocketMessage(pc *webrtc.PeerConnection, ws *websocket.Conn, messa
 }
 
 func serveWs(w http.ResponseWriter, r *http.Request) {
+	name := viewerStreamName(r)
+	expires, ok := authorizeViewer(w, r, name)
+	if !ok {
+		return
+	}
+	s := findStream(name)
+	if s == nil || !s.conf.hasOutput("webrtc") {
+		http.Error(w, fmt.Sprintf("stream '%s' not found", name), http.StatusNotFound)
+		return
+	}
+
+	// the upgrader answers failed handshakes, such as origins which aren't allowed
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		if _, ok := err.(websocket.HandshakeError); !ok {
-			panic(err)
-		}
+		log.Printf("websocket from %s: %s", r.RemoteAddr, err.Error())
+		return
+	}
+
+	// the page is told why it is rejected, before any resource is allocated for it
+	leave, reason := admitViewer(s, r)
+	if leave == nil {
+		log.Printf("viewer %s of '%s' rejected: %s", r.RemoteAddr, s.name, reason)
+		ws.WriteJSON(&websocketMessage{Event: "rejected", Data: reason}) //nolint:errcheck
+		ws.Close()
+		return
+	}
+	defer leave()
+
+	recovery := &recoveryCounter{}
+	api, estimators, err := newViewerAPI(s.mimeType, recovery)
+	if err != nil {
+		panic(err)
+	}
+	peerConnection, err := api.NewPeerConnection(peerConnectionConfig)
+	if err != nil {
+		panic(err)
+	}
+	var bwe cc.BandwidthEstimator
+	select {
+	case bwe = <-estimators:
+	default:
 	}
 
-	peerConnection, err := webrtc.NewPeerConnection(peerConnectionConfig)
+	// each peer has its own track, fed by the layer it watches and thinned out when it is congested
+	track, err := newPeerTrack(s.track.Codec())
 	if err != nil {
 		panic(err)
 	}
 
-	if _, err = peerConnection.AddTrack(videoTrackRTP); err != nil {
+	sender, err := peerConnection.AddTrack(track.track)
+	if err != nil {
 		panic(err)
 	}
 
+	if s.audioTrack != nil {
+		if _, err := peerConnection.AddTrack(s.audioTrack); err != nil {
+			panic(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// registered before the negotiation so that no change is missed
+	stateChanged := make(chan struct{}, 1)
+	peerConnection.OnConnectionStateChange(func(webrtc.PeerConnectionState) {
+		select {
+		case stateChanged <- struct{}{}:
+		default:
+		}
+	})
+
 	defer func() {
 		if err := peerConnection.Close(); err != nil {
 			panic(err)
 		}
 	}()
 
+	// viewers are disconnected when the stream is removed or restarted
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			ws.Close()
+		case <-ctx.Done():
+		}
+	}()
+
+	p := &peer{
+		stream:     s,
+		pc:         peerConnection,
+		ws:         ws,
+		sender:     sender,
+		remoteAddr: r.RemoteAddr,
+		ctx:        ctx,
+		track:      track,
+		bwe:        bwe,
+		recovery:   recovery,
+	}
+	p.layerMode.Store("auto")
+	p.keyFramesOnly.Store(r.URL.Query().Get("keyframes") == "1")
+	if frameRate, err := strconv.Atoi(r.URL.Query().Get("fps")); err == nil && frameRate > 0 && frameRate <= maxViewerFrameRate {
+		p.maxFrameRate.Store(int32(frameRate))
+	}
+
+	// viewers are disconnected when their credentials expire, the page doesn't connect again
+	if !expires.IsZero() {
+		t := time.AfterFunc(time.Until(expires), func() {
+			log.Printf("viewer %s of '%s': credentials expired", r.RemoteAddr, s.name)
+			p.writeMessage(&websocketMessage{Event: "rejected", Data: "credentials expired"}) //nolint:errcheck
+
+			peerConnection.Close() //nolint:errcheck
+			ws.Close()
+		})
+		defer t.Stop()
+	}
+
+	go p.notifyStalled()
+	go p.superviseConnection(stateChanged)
+	go p.readRTCP()
+
+	s.subscribe(track, mainLayer)
+	defer s.unsubscribe(track)
+	if s.sub != nil {
+		s.sub.subscribe(track, subLayer)
+		defer s.sub.unsubscribe(track)
+	}
+	go p.adapt()
+
 	message := &websocketMessage{}
 	for {
 		_, msg, err := ws.ReadMessage()
 		if err != nil {
 			break
 		} else if err := json.Unmarshal(msg, &message); err != nil {
-			panic(err)
+			log.Printf("websocket message: %s", err.Error())
+			continue
 		}
 
-		if err := handleWebsocketMessage(peerConnection, ws, message); err != nil {
-			panic(err)
+		if err := handleWebsocketMessage(p, message); err != nil {
+			log.Printf("websocket message '%s': %s", message.Event, err.Error())
 		}
 	}
 }
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorizeViewer(w, r, viewerStreamName(r)); !ok {
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	fmt.Fprint(w, homeHTML)
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// allowedOrigins are patterns of the origins, besides the one of the bridge itself,
+// which can open the websocket and call the HTTP endpoints from a browser.
+var allowedOrigins []string
+
+// originAllowed returns whether a browser page of origin can use the endpoints of r.
+// Requests without an origin don't come from browsers and are allowed.
+func originAllowed(r *http.Request, origin string) bool {
+	if origin == "" {
+		return true
+	}
+
+	if sameOrigin(r, origin) {
+		return true
+	}
+
+	for _, pattern := range allowedOrigins {
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin returns whether origin is the one of the bridge itself.
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func checkWebsocketOrigin(r *http.Request) bool {
+	return originAllowed(r, r.Header.Get("Origin"))
+}
+
+// withCORS adds the CORS headers for allowed origins and answers preflight requests.
+func withCORS(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin != "" && originAllowed(r, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		h(w, r)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	defer func(origins []string) { allowedOrigins = origins }(allowedOrigins)
+	allowedOrigins = []string{"https://portal.example.com", "https://*.example.org"}
+
+	for _, ca := range []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"http://bridge.example.com:8080", true},
+		{"https://bridge.example.com:8080", true},
+		{"http://bridge.example.com", false},
+		{"https://portal.example.com", true},
+		{"http://portal.example.com", false},
+		{"https://portal.example.com:8443", false},
+		{"https://a.example.org", true},
+		{"https://example.org", false},
+		{"https://a.example.org.evil.com", false},
+		{"https://evil.com", false},
+		{"null", false},
+	} {
+		t.Run(ca.origin, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://bridge.example.com:8080/ws", nil)
+			if ok := originAllowed(r, ca.origin); ok != ca.ok {
+				t.Errorf("expected %v, got %v", ca.ok, ok)
+			}
+		})
+	}
+}
+
+func TestWithCORS(t *testing.T) {
+	defer func(origins []string) { allowedOrigins = origins }(allowedOrigins)
+	allowedOrigins = []string{"https://portal.example.com"}
+
+	for _, ca := range []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		allowOrigin string
+		called      bool
+		code        int
+	}{
+		{"no origin", http.MethodGet, "", false, "", true, http.StatusOK},
+		{"allowed origin", http.MethodGet, "https://portal.example.com", false, "https://portal.example.com", true, http.StatusOK},
+		{"other origin", http.MethodGet, "https://evil.com", false, "", true, http.StatusOK},
+		{"preflight", http.MethodOptions, "https://portal.example.com", true, "https://portal.example.com", false, http.StatusNoContent},
+		{"preflight of other origin", http.MethodOptions, "https://evil.com", true, "", true, http.StatusOK},
+		{"options without preflight", http.MethodOptions, "https://portal.example.com", false, "https://portal.example.com", true, http.StatusOK},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			r := httptest.NewRequest(ca.method, "http://bridge.example.com/api/streams", nil)
+			if ca.origin != "" {
+				r.Header.Set("Origin", ca.origin)
+			}
+			if ca.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+
+			called := false
+			w := httptest.NewRecorder()
+			withCORS(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})(w, r)
+
+			if called != ca.called {
+				t.Errorf("expected the handler to be called: %v, got %v", ca.called, called)
+			}
+			if w.Code != ca.code {
+				t.Errorf("expected status %d, got %d", ca.code, w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != ca.allowOrigin {
+				t.Errorf("expected Access-Control-Allow-Origin '%s', got '%s'", ca.allowOrigin, got)
+			}
+			if w.Header().Get("Vary") != "Origin" {
+				t.Error("expected Vary: Origin")
+			}
+		})
+	}
+}
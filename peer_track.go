@@ -0,0 +1,371 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// layers of a stream with a sub source
+const (
+	mainLayer = 0
+	subLayer  = 1
+)
+
+var layerNames = map[int]string{mainLayer: "main", subLayer: "sub"}
+
+const (
+	// the sub stream is only watched live
+	subStreamDVRWindow = 10 * time.Second
+
+	// how often the quality sent to each peer is chosen again
+	adaptInterval = time.Second
+
+	// minimum time between a change of quality and the next decrease,
+	// so that the bitrate reflects the previous change
+	decreaseSettleTime = 2 * time.Second
+
+	// time without congestion after which a better quality is tried, doubled every time the
+	// attempt fails soon after, and reset when no congestion is detected for resetProbeTime
+	minProbeTime   = 5 * time.Second
+	maxProbeTime   = 80 * time.Second
+	resetProbeTime = time.Minute
+
+	// frame rate sent to congested peers before they fall back to key frames
+	congestedFrameRate = 10
+
+	// highest frame rate viewers can ask for
+	maxViewerFrameRate = 120
+)
+
+// peerTrack is the video track of a single peer, fed from the main or the sub layer of its stream.
+// Layers change at key frames, non-key frames can be dropped, and the numbering of the track
+// stays continuous.
+type peerTrack struct {
+	track *webrtc.TrackLocalStaticRTP
+
+	// payload bytes written to the track
+	bytesWritten atomic.Uint64
+
+	// *peerStats, updated by the adaptation of the peer
+	stats atomic.Value
+
+	mutex sync.Mutex
+	// -1 until the first key frame
+	current       int
+	target        int
+	keyFramesOnly bool
+	// set while non-key frames are dropped, until the next key frame
+	dropping bool
+	// maximum frames per second, approached by dropping disposable access units, 0 for all of them
+	frameRate int
+	// timestamp from which the next disposable access unit can be sent
+	nextFrame uint32
+
+	seqOffset          uint16
+	tsOffset           uint32
+	lastSequenceNumber uint16
+	lastTimestamp      uint32
+	lastWrite          time.Time
+}
+
+func newPeerTrack(codec webrtc.RTPCodecCapability) (*peerTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, "synced-video", "synced-video")
+	if err != nil {
+		return nil, err
+	}
+
+	return &peerTrack{
+		track:   track,
+		current: -1,
+		target:  mainLayer,
+	}, nil
+}
+
+// push writes the packets of an access unit of layer when it is the current one,
+// or when it is the target one and the access unit is a key frame.
+func (pt *peerTrack) push(layer int, packets []*rtp.Packet, keyFrame bool, disposable bool) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	if layer != pt.current {
+		if layer != pt.target || !keyFrame {
+			return
+		}
+		pt.current = layer
+
+		if !pt.lastWrite.IsZero() {
+			gap := ptsToTimestamp(time.Since(pt.lastWrite))
+			if gap < discontinuityGap {
+				gap = discontinuityGap
+			}
+			pt.seqOffset = pt.lastSequenceNumber + 1 - packets[0].SequenceNumber
+			pt.tsOffset = pt.lastTimestamp + gap - packets[0].Timestamp
+		}
+	}
+
+	// frames following a dropped one can't be decoded until the next key frame,
+	// sequence numbers skip the dropped packets so that the peer doesn't ask for them
+	if keyFrame {
+		pt.dropping = pt.keyFramesOnly
+	}
+	if pt.dropping && !keyFrame {
+		pt.seqOffset -= uint16(len(packets))
+		return
+	}
+
+	// disposable access units are skipped when they come before their turn, the others are always sent
+	// and delay the next turn, by no more than an interval
+	if pt.frameRate != 0 {
+		timestamp := packets[0].Timestamp + pt.tsOffset
+		interval := uint32(videoClockRate / pt.frameRate)
+		delta := int32(timestamp - pt.nextFrame)
+		if delta > int32(interval) || delta < -int32(interval) {
+			pt.nextFrame, delta = timestamp, 0
+		}
+		if disposable && delta < 0 {
+			pt.seqOffset -= uint16(len(packets))
+			return
+		}
+		pt.nextFrame += interval
+		if int32(pt.nextFrame-timestamp) > int32(interval) {
+			pt.nextFrame = timestamp + interval
+		}
+	}
+
+	for _, pkt := range packets {
+		// the packets are shared with the other peers
+		out := *pkt
+		out.SequenceNumber += pt.seqOffset
+		out.Timestamp += pt.tsOffset
+		if err := pt.track.WriteRTP(&out); err != nil {
+			log.Printf("WriteRTP err: %s", err.Error())
+		}
+		pt.lastSequenceNumber = out.SequenceNumber
+		pt.lastTimestamp = out.Timestamp
+		pt.bytesWritten.Add(uint64(len(out.Payload)))
+	}
+	pt.lastWrite = time.Now()
+}
+
+// set chooses the layer and whether non-key frames are dropped, both applied from the next key frame,
+// and the frame rate.
+func (pt *peerTrack) set(q quality) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.target = q.layer
+	pt.keyFramesOnly = q.keyFramesOnly
+	pt.frameRate = q.frameRate
+}
+
+func (pt *peerTrack) state() (int, bool) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	return pt.current, pt.dropping
+}
+
+// last returns the header of the last packet written to the track.
+func (pt *peerTrack) last() (uint16, uint32) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	return pt.lastSequenceNumber, pt.lastTimestamp
+}
+
+// quality is a level of the video sent to a peer.
+type quality struct {
+	layer         int
+	keyFramesOnly bool
+	// 0 for all frames
+	frameRate int
+}
+
+// qualities returns the levels a peer can watch, from the best to the worst: the layers the page allows,
+// without those whose source stalled, followed by the last one at congestedFrameRate, then by its key frames.
+// Viewers who asked for the key frames only get the key frames of every layer, the frame rate they asked for
+// caps every level.
+func (p *peer) qualities() []quality {
+	layers := []int{mainLayer}
+	if sub := p.stream.sub; sub != nil {
+		mainStalled, _ := p.stream.stalledState()
+		subStalled, _ := sub.stalledState()
+
+		switch {
+		case mainStalled && !subStalled:
+			layers = []int{subLayer}
+		case subStalled:
+			layers = []int{mainLayer}
+		case p.layerMode.Load() == "main":
+			layers = []int{mainLayer}
+		case p.layerMode.Load() == "sub":
+			layers = []int{subLayer}
+		default:
+			layers = []int{mainLayer, subLayer}
+		}
+	}
+
+	keyFramesOnly := p.keyFramesOnly.Load()
+	frameRate := int(p.maxFrameRate.Load())
+	qualities := make([]quality, 0, len(layers)+2)
+	for _, l := range layers {
+		qualities = append(qualities, quality{layer: l, keyFramesOnly: keyFramesOnly, frameRate: frameRate})
+	}
+	if keyFramesOnly {
+		return qualities
+	}
+
+	// VP8 access units are never disposable
+	last := layers[len(layers)-1]
+	if p.stream.mimeType != webrtc.MimeTypeVP8 && (frameRate == 0 || frameRate > congestedFrameRate) {
+		qualities = append(qualities, quality{layer: last, frameRate: congestedFrameRate})
+	}
+	return append(qualities, quality{layer: last, keyFramesOnly: true})
+}
+
+// bandwidthEstimate returns the bandwidth of the peer in bits per second, 0 when unknown:
+// the estimate of the congestion controller, capped by the REMB of the peer.
+func (p *peer) bandwidthEstimate() uint64 {
+	estimate := uint64(0)
+	if p.bwe != nil {
+		estimate = uint64(p.bwe.GetTargetBitrate())
+	}
+	if remb := p.remb.Load(); remb != 0 && (estimate == 0 || remb < estimate) {
+		estimate = remb
+	}
+	return estimate
+}
+
+// adapt chooses the quality sent to the peer every adaptInterval: it is decreased when the bitrate sent to the
+// peer exceeds its bandwidth estimate, and a better one is tried after a while without congestion.
+// The layer in use is reported to the page.
+func (p *peer) adapt() {
+	t := time.NewTicker(adaptInterval)
+	defer t.Stop()
+
+	level := 0
+	lastMode, lastKeyFramesOnly, lastFrameRate := p.layerMode.Load(), p.keyFramesOnly.Load(), p.maxFrameRate.Load()
+	lastChange, lastIncrease, lastCongestion := time.Now(), time.Time{}, time.Now()
+	probeTime := minProbeTime
+
+	// the first frames already follow the choices of the viewer
+	q := p.qualities()[0]
+	p.track.set(q)
+
+	lastBytes := p.track.bytesWritten.Load()
+	sentBitrate := 0.0
+	reported := -1
+
+	for {
+		select {
+		case <-t.C:
+		case <-p.ctx.Done():
+			return
+		}
+		now := time.Now()
+
+		// smooth the bitrate, which peaks with key frames
+		bytes := p.track.bytesWritten.Load()
+		sample := float64(bytes-lastBytes) * 8 / adaptInterval.Seconds()
+		lastBytes = bytes
+		sentBitrate = 0.8*sentBitrate + 0.2*sample
+
+		qualities := p.qualities()
+		// the choices of the viewer start again from the best quality
+		mode, keyFramesOnly, frameRate := p.layerMode.Load(), p.keyFramesOnly.Load(), p.maxFrameRate.Load()
+		if mode != lastMode || keyFramesOnly != lastKeyFramesOnly || frameRate != lastFrameRate {
+			lastMode, lastKeyFramesOnly, lastFrameRate = mode, keyFramesOnly, frameRate
+			level = 0
+		}
+		if level >= len(qualities) {
+			level = len(qualities) - 1
+		}
+
+		estimate := p.bandwidthEstimate()
+		congested := estimate != 0 && float64(estimate) < sentBitrate
+		switch {
+		case congested:
+			lastCongestion = now
+			if level < len(qualities)-1 && now.Sub(lastChange) >= decreaseSettleTime {
+				if now.Sub(lastIncrease) < probeTime {
+					probeTime *= 2
+					if probeTime > maxProbeTime {
+						probeTime = maxProbeTime
+					}
+				}
+				level++
+				lastChange = now
+			}
+
+		case level > 0 && now.Sub(lastChange) >= probeTime:
+			level--
+			lastChange, lastIncrease = now, now
+
+		case now.Sub(lastCongestion) >= resetProbeTime:
+			probeTime = minProbeTime
+		}
+
+		q := qualities[level]
+		p.track.set(q)
+
+		current, dropping := p.track.state()
+		p.track.stats.Store(&peerStats{
+			Layer:         layerNames[current],
+			KeyFramesOnly: dropping,
+			FrameRate:     q.frameRate,
+			SentBitrate:   uint64(sentBitrate),
+			Estimate:      estimate,
+			NACKedPackets: p.nacked.Load(),
+			RTXPackets:    p.recovery.retransmitted.Load(),
+			FECPackets:    p.recovery.fec.Load(),
+		})
+
+		if p.stream.sub != nil && current != reported && current >= 0 {
+			if err := p.writeMessage(&websocketMessage{Event: "layer", Data: layerNames[current]}); err != nil {
+				return
+			}
+			reported = current
+		}
+	}
+}
+
+type peerStats struct {
+	Layer         string `json:"layer,omitempty"`
+	KeyFramesOnly bool   `json:"keyFramesOnly"`
+	// frames per second the track is limited to, 0 for all of them
+	FrameRate int `json:"frameRate"`
+	// bits per second
+	SentBitrate uint64 `json:"sentBitrate"`
+	Estimate    uint64 `json:"estimate"`
+	// packets reported lost by the viewer, retransmitted on the video or the RTX stream
+	NACKedPackets uint64 `json:"nackedPackets"`
+	RTXPackets    uint64 `json:"rtxPackets"`
+	// FEC packets recover losses in the browser, which doesn't report them
+	FECPackets uint64 `json:"fecPackets"`
+}
+
+// readRTCP reads the feedback of the viewer, which runs the interceptors,
+// keeps the latest REMB and counts the packets it asks again.
+func (p *peer) readRTCP() {
+	for {
+		pkts, _, err := p.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, pkt := range pkts {
+			switch pkt := pkt.(type) {
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				p.remb.Store(uint64(pkt.Bitrate))
+
+			case *rtcp.TransportLayerNack:
+				for _, pair := range pkt.Nacks {
+					p.nacked.Add(uint64(len(pair.PacketList())))
+				}
+			}
+		}
+	}
+}
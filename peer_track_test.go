@@ -0,0 +1,260 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// trackRecorder is bound to a track like a peer connection and records the packets written to it.
+type trackRecorder struct {
+	codec   webrtc.RTPCodecParameters
+	written []rtp.Header
+}
+
+func (r *trackRecorder) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{r.codec}
+}
+func (r *trackRecorder) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (r *trackRecorder) SSRC() webrtc.SSRC                                      { return 1 }
+func (r *trackRecorder) SSRCRetransmission() webrtc.SSRC                        { return 0 }
+func (r *trackRecorder) SSRCForwardErrorCorrection() webrtc.SSRC                { return 0 }
+func (r *trackRecorder) WriteStream() webrtc.TrackLocalWriter                   { return r }
+func (r *trackRecorder) ID() string                                             { return "recorder" }
+func (r *trackRecorder) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+func (r *trackRecorder) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	r.written = append(r.written, *header)
+	return len(payload), nil
+}
+
+func (r *trackRecorder) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func newRecordedPeerTrack(t *testing.T) (*peerTrack, *trackRecorder) {
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: videoClockRate}
+	pt, err := newPeerTrack(codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &trackRecorder{codec: webrtc.RTPCodecParameters{RTPCodecCapability: codec, PayloadType: 96}}
+	if _, err := pt.track.Bind(rec); err != nil {
+		t.Fatal(err)
+	}
+	return pt, rec
+}
+
+// accessUnit is pushed to a peerTrack, numbered from seq.
+type accessUnit struct {
+	layer      int
+	seq        uint16
+	ts         uint32
+	packets    int
+	keyFrame   bool
+	disposable bool
+}
+
+func (au accessUnit) push(pt *peerTrack) {
+	packets := make([]*rtp.Packet, au.packets)
+	for i := range packets {
+		packets[i] = &rtp.Packet{Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: au.seq + uint16(i),
+			Timestamp:      au.ts,
+			Marker:         i == au.packets-1,
+		}}
+	}
+	pt.push(au.layer, packets, au.keyFrame, au.disposable)
+}
+
+type writtenPacket struct {
+	seq uint16
+	ts  uint32
+}
+
+func checkWritten(t *testing.T, rec *trackRecorder, expected []writtenPacket) {
+	t.Helper()
+
+	if len(rec.written) != len(expected) {
+		t.Fatalf("expected %d packets, got %d: %v", len(expected), len(rec.written), rec.written)
+	}
+	for i, e := range expected {
+		if got := rec.written[i]; got.SequenceNumber != e.seq || got.Timestamp != e.ts {
+			t.Errorf("packet %d: expected seq %d ts %d, got seq %d ts %d",
+				i, e.seq, e.ts, got.SequenceNumber, got.Timestamp)
+		}
+	}
+	rec.written = nil
+}
+
+func TestPeerTrackWaitsForKeyFrame(t *testing.T) {
+	pt, rec := newRecordedPeerTrack(t)
+
+	accessUnit{layer: mainLayer, seq: 10, ts: 1000, packets: 2}.push(pt)
+	accessUnit{layer: subLayer, seq: 50, ts: 5000, packets: 1, keyFrame: true}.push(pt)
+	checkWritten(t, rec, nil)
+
+	accessUnit{layer: mainLayer, seq: 12, ts: 4000, packets: 2, keyFrame: true}.push(pt)
+	accessUnit{layer: mainLayer, seq: 14, ts: 7000, packets: 1}.push(pt)
+	checkWritten(t, rec, []writtenPacket{{12, 4000}, {13, 4000}, {14, 7000}})
+
+	if current, _ := pt.state(); current != mainLayer {
+		t.Errorf("expected the main layer, got %d", current)
+	}
+}
+
+func TestPeerTrackSwitchesLayers(t *testing.T) {
+	pt, rec := newRecordedPeerTrack(t)
+
+	accessUnit{layer: mainLayer, seq: 100, ts: 1000, packets: 2, keyFrame: true}.push(pt)
+	checkWritten(t, rec, []writtenPacket{{100, 1000}, {101, 1000}})
+
+	// the main layer goes on until a key frame of the sub layer
+	pt.set(quality{layer: subLayer})
+	accessUnit{layer: subLayer, seq: 500, ts: 90000, packets: 1}.push(pt)
+	accessUnit{layer: mainLayer, seq: 102, ts: 4000, packets: 1}.push(pt)
+	checkWritten(t, rec, []writtenPacket{{102, 4000}})
+
+	// the sub layer continues the numbering, a frame later
+	accessUnit{layer: subLayer, seq: 501, ts: 93000, packets: 2, keyFrame: true}.push(pt)
+	accessUnit{layer: mainLayer, seq: 103, ts: 7000, packets: 1, keyFrame: true}.push(pt)
+	accessUnit{layer: subLayer, seq: 503, ts: 96000, packets: 1}.push(pt)
+	checkWritten(t, rec, []writtenPacket{
+		{103, 4000 + discontinuityGap}, {104, 4000 + discontinuityGap},
+		{105, 7000 + discontinuityGap},
+	})
+
+	// and so does the main layer when it comes back
+	pt.set(quality{layer: mainLayer})
+	accessUnit{layer: mainLayer, seq: 110, ts: 25000, packets: 1, keyFrame: true}.push(pt)
+	checkWritten(t, rec, []writtenPacket{{106, 7000 + 2*discontinuityGap}})
+
+	if current, _ := pt.state(); current != mainLayer {
+		t.Errorf("expected the main layer, got %d", current)
+	}
+}
+
+func TestPeerTrackSequenceWraps(t *testing.T) {
+	pt, rec := newRecordedPeerTrack(t)
+
+	accessUnit{layer: mainLayer, seq: 65534, ts: 4294967000, packets: 2, keyFrame: true}.push(pt)
+	pt.set(quality{layer: subLayer})
+	accessUnit{layer: subLayer, seq: 20, ts: 500, packets: 2, keyFrame: true}.push(pt)
+	checkWritten(t, rec, []writtenPacket{
+		{65534, 4294967000}, {65535, 4294967000},
+		{0, 4294967000 + discontinuityGap - 1<<32}, {1, 4294967000 + discontinuityGap - 1<<32},
+	})
+}
+
+func TestPeerTrackKeyFramesOnly(t *testing.T) {
+	pt, rec := newRecordedPeerTrack(t)
+	pt.set(quality{layer: mainLayer, keyFramesOnly: true})
+
+	// sequence numbers skip the dropped packets, timestamps are kept
+	accessUnit{layer: mainLayer, seq: 10, ts: 0, packets: 2, keyFrame: true}.push(pt)
+	accessUnit{layer: mainLayer, seq: 12, ts: 3000, packets: 1}.push(pt)
+	accessUnit{layer: mainLayer, seq: 13, ts: 6000, packets: 2}.push(pt)
+	accessUnit{layer: mainLayer, seq: 15, ts: 9000, packets: 1, keyFrame: true}.push(pt)
+	checkWritten(t, rec, []writtenPacket{{10, 0}, {11, 0}, {12, 9000}})
+
+	if _, dropping := pt.state(); !dropping {
+		t.Error("expected non-key frames to be dropped")
+	}
+
+	// non-key frames come back from the next key frame
+	pt.set(quality{layer: mainLayer})
+	accessUnit{layer: mainLayer, seq: 16, ts: 12000, packets: 1}.push(pt)
+	accessUnit{layer: mainLayer, seq: 17, ts: 15000, packets: 1, keyFrame: true}.push(pt)
+	accessUnit{layer: mainLayer, seq: 18, ts: 18000, packets: 1}.push(pt)
+	checkWritten(t, rec, []writtenPacket{{13, 15000}, {14, 18000}})
+
+	if _, dropping := pt.state(); dropping {
+		t.Error("expected non-key frames to be sent")
+	}
+	if seq, ts := pt.last(); seq != 14 || ts != 18000 {
+		t.Errorf("expected the last packet to be seq 14 ts 18000, got seq %d ts %d", seq, ts)
+	}
+}
+
+func TestPeerTrackFrameRate(t *testing.T) {
+	for _, ca := range []struct {
+		name      string
+		frameRate int
+		aus       []accessUnit
+		expected  []writtenPacket
+	}{
+		{
+			"disposable frames at twice the rate",
+			30,
+			[]accessUnit{
+				{seq: 0, ts: 0, packets: 1, keyFrame: true},
+				{seq: 1, ts: 1500, packets: 1, disposable: true},
+				{seq: 2, ts: 3000, packets: 1, disposable: true},
+				{seq: 3, ts: 4500, packets: 2, disposable: true},
+				{seq: 5, ts: 6000, packets: 1, disposable: true},
+				{seq: 6, ts: 7500, packets: 1, disposable: true},
+				{seq: 7, ts: 9000, packets: 1, disposable: true},
+			},
+			[]writtenPacket{{0, 0}, {1, 3000}, {2, 6000}, {3, 9000}},
+		},
+		{
+			"reference frames are always sent",
+			30,
+			[]accessUnit{
+				{seq: 0, ts: 0, packets: 1, keyFrame: true},
+				{seq: 1, ts: 1500, packets: 1},
+				{seq: 2, ts: 3000, packets: 1},
+				{seq: 3, ts: 4500, packets: 1, disposable: true},
+				{seq: 4, ts: 6000, packets: 1},
+				{seq: 5, ts: 7500, packets: 1, disposable: true},
+				{seq: 6, ts: 9000, packets: 1, disposable: true},
+			},
+			[]writtenPacket{{0, 0}, {1, 1500}, {2, 3000}, {3, 6000}, {4, 9000}},
+		},
+		{
+			"schedule resyncs after a gap",
+			30,
+			[]accessUnit{
+				{seq: 0, ts: 0, packets: 1, keyFrame: true},
+				{seq: 1, ts: 90000, packets: 1, disposable: true},
+				{seq: 2, ts: 91500, packets: 1, disposable: true},
+				{seq: 3, ts: 93000, packets: 1, disposable: true},
+			},
+			[]writtenPacket{{0, 0}, {1, 90000}, {2, 93000}},
+		},
+		{
+			"slower source",
+			30,
+			[]accessUnit{
+				{seq: 0, ts: 0, packets: 1, keyFrame: true},
+				{seq: 1, ts: 6000, packets: 1, disposable: true},
+				{seq: 2, ts: 12000, packets: 1, disposable: true},
+			},
+			[]writtenPacket{{0, 0}, {1, 6000}, {2, 12000}},
+		},
+		{
+			"all frames",
+			0,
+			[]accessUnit{
+				{seq: 0, ts: 0, packets: 1, keyFrame: true},
+				{seq: 1, ts: 1500, packets: 1, disposable: true},
+				{seq: 2, ts: 3000, packets: 1, disposable: true},
+			},
+			[]writtenPacket{{0, 0}, {1, 1500}, {2, 3000}},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			pt, rec := newRecordedPeerTrack(t)
+			pt.set(quality{layer: mainLayer, frameRate: ca.frameRate})
+
+			for _, au := range ca.aus {
+				au.push(pt)
+			}
+			checkWritten(t, rec, ca.expected)
+		})
+	}
+}
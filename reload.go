@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+var (
+	confMutex sync.Mutex
+	// empty when the configuration comes from the command line
+	reloadPath  string
+	currentConf *conf
+	// streams created through the API, which are left untouched by reloads
+	apiStreams = map[string]*streamConf{}
+)
+
+type reloadResult struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Restarted []string `json:"restarted"`
+	// streams which couldn't be started, they are tried again on the next reload
+	Failed []string `json:"failed"`
+}
+
+// reloadConf reads the configuration file again and applies the changes to the streams.
+// Streams whose configuration didn't change keep running, together with their viewers.
+func reloadConf() (*reloadResult, error) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+
+	if reloadPath == "" {
+		return nil, errors.New("the configuration doesn't come from a file")
+	}
+
+	newConf, err := loadConf(reloadPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// only streams can be changed at runtime
+	oldSettings, newSettings := *currentConf, *newConf
+	oldSettings.Streams, newSettings.Streams = nil, nil
+	if !reflect.DeepEqual(oldSettings, newSettings) {
+		log.Println("reload: changes to the settings outside of streams require a restart and are ignored")
+	}
+
+	// the first stream of the file stays the default one even when the API owns its name,
+	// the streams created through the API keep their name
+	defaultStream := newConf.Streams[0].Name
+	fileStreams := newConf.Streams[:0:0]
+	for _, sc := range newConf.Streams {
+		if _, ok := apiStreams[sc.Name]; ok {
+			log.Printf("reload: stream '%s' was created through the API and is left untouched", sc.Name)
+			continue
+		}
+		fileStreams = append(fileStreams, sc)
+	}
+	newConf.Streams = fileStreams
+
+	oldStreams := make(map[string]*streamConf)
+	for _, sc := range currentConf.Streams {
+		oldStreams[sc.Name] = sc
+	}
+
+	res := &reloadResult{Added: []string{}, Removed: []string{}, Restarted: []string{}, Failed: []string{}}
+
+	newStreams := make(map[string]struct{})
+	for _, sc := range newConf.Streams {
+		newStreams[sc.Name] = struct{}{}
+	}
+
+	for _, sc := range currentConf.Streams {
+		if _, ok := newStreams[sc.Name]; !ok {
+			removeStream(sc.Name)
+			res.Removed = append(res.Removed, sc.Name)
+		}
+	}
+
+	// the streams which failed to start are left out, so that the next reload adds them again
+	running := newConf.Streams[:0:0]
+	for _, sc := range newConf.Streams {
+		old, ok := oldStreams[sc.Name]
+		if ok && reflect.DeepEqual(old, sc) {
+			running = append(running, sc)
+			continue
+		}
+		if ok {
+			removeStream(sc.Name)
+		}
+
+		if _, err := startStream(sc, currentConf.DVRWindow); err != nil {
+			log.Printf("reload: stream '%s': %s", sc.Name, err.Error())
+			res.Failed = append(res.Failed, sc.Name)
+			continue
+		}
+		running = append(running, sc)
+
+		if ok {
+			res.Restarted = append(res.Restarted, sc.Name)
+		} else {
+			res.Added = append(res.Added, sc.Name)
+		}
+	}
+
+	setDefaultStream(defaultStream)
+	currentConf.Streams = running
+
+	log.Printf("reload: added %v, removed %v, restarted %v, failed %v", res.Added, res.Removed, res.Restarted, res.Failed)
+	return res, nil
+}
+
+func reloadOnSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		if _, err := reloadConf(); err != nil {
+			log.Printf("reload: %s", err.Error())
+		}
+	}
+}
+
+// serveReload handles POST /api/reload, which is equivalent to SIGHUP.
+func serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := reloadConf()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res) //nolint:errcheck
+}
+
+var (
+	errStreamExists   = errors.New("stream already exists")
+	errStreamNotFound = errors.New("stream not found")
+	// viewers which don't pick a stream would be left without one
+	errDefaultStream = errors.New("default stream")
+)
+
+// createStream starts a stream which isn't part of the configuration file.
+func createStream(sc *streamConf) error {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+
+	if err := currentConf.validateStream(sc); err != nil {
+		return err
+	}
+
+	if findStream(sc.Name) != nil {
+		return errStreamExists
+	}
+
+	if _, err := startStream(sc, currentConf.DVRWindow); err != nil {
+		return err
+	}
+	apiStreams[sc.Name] = sc
+	log.Printf("stream '%s' created", sc.Name)
+	return nil
+}
+
+// deleteStream stops a stream, a stream of the configuration file comes back on the next reload.
+func deleteStream(name string) error {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+
+	if findStream(name) == nil {
+		return errStreamNotFound
+	}
+	if name == defaultStream() {
+		return errDefaultStream
+	}
+
+	removeStream(name)
+	delete(apiStreams, name)
+
+	streams := currentConf.Streams[:0:0]
+	for _, sc := range currentConf.Streams {
+		if sc.Name != name {
+			streams = append(streams, sc)
+		}
+	}
+	currentConf.Streams = streams
+
+	log.Printf("stream '%s' deleted", name)
+	return nil
+}
+
+// listStreams returns the configuration of the running streams.
+func listStreams() []*streamConf {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+
+	list := append([]*streamConf{}, currentConf.Streams...)
+	for _, sc := range apiStreams {
+		list = append(list, sc)
+	}
+	return list
+}
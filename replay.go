@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph265"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtpvp8"
+	"github.com/nicksanford/rtspwebrtcbridge/dvr"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	videoClockRate = 90000
+	// RTP timestamp gap inserted when playback jumps to another position.
+	discontinuityGap = videoClockRate / 30
+)
+
+type rtpEncoder interface {
+	Encode(au [][]byte) ([]*rtp.Packet, error)
+}
+
+// vp8Encoder adapts rtpvp8.Encoder to rtpEncoder, VP8 entries hold a single frame.
+type vp8Encoder struct {
+	*rtpvp8.Encoder
+}
+
+func (e vp8Encoder) Encode(au [][]byte) ([]*rtp.Packet, error) {
+	return e.Encoder.Encode(au[0])
+}
+
+func newRTPEncoder(mimeType string, initialSequenceNumber uint16) (rtpEncoder, error) {
+	switch mimeType {
+	case webrtc.MimeTypeH264:
+		e := &rtph264.Encoder{
+			PayloadType:           96,
+			PayloadMaxSize:        webrtcPayloadMaxSize,
+			InitialSequenceNumber: &initialSequenceNumber,
+		}
+		return e, e.Init()
+
+	case webrtc.MimeTypeH265:
+		e := &rtph265.Encoder{
+			PayloadType:           96,
+			PayloadMaxSize:        webrtcPayloadMaxSize,
+			InitialSequenceNumber: &initialSequenceNumber,
+		}
+		return e, e.Init()
+
+	case webrtc.MimeTypeVP8:
+		e := &rtpvp8.Encoder{
+			PayloadType:           96,
+			PayloadMaxSize:        webrtcPayloadMaxSize,
+			InitialSequenceNumber: &initialSequenceNumber,
+		}
+		return vp8Encoder{e}, e.Init()
+
+	default:
+		return nil, errors.New("unsupported mime type " + mimeType)
+	}
+}
+
+type replayCommand struct {
+	event string
+	at    time.Time
+}
+
+// replayer feeds a per-peer track from the DVR buffer, starting from the key
+// frame preceding the requested position and following the buffer at real-time pace.
+// Once a peer has rewound it keeps its own track, also when it returns to live.
+type replayer struct {
+	track    *webrtc.TrackLocalStaticRTP
+	buffer   *dvr.Buffer
+	encoder  rtpEncoder
+	commands chan replayCommand
+
+	pos          uint64
+	paused       bool
+	catchUp      bool
+	resync       bool
+	restartClock bool
+	startWall    time.Time
+	startPTS     time.Duration
+	tsOffset     uint32
+	lastTS       uint32
+}
+
+func newReplayer(
+	buffer *dvr.Buffer,
+	codec webrtc.RTPCodecCapability,
+	lastSequenceNumber uint16,
+	lastTimestamp uint32,
+) (*replayer, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, "synced-video", "synced-video")
+	if err != nil {
+		return nil, err
+	}
+
+	encoder, err := newRTPEncoder(codec.MimeType, lastSequenceNumber+1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &replayer{
+		track:    track,
+		buffer:   buffer,
+		encoder:  encoder,
+		commands: make(chan replayCommand),
+		paused:   true,
+		lastTS:   lastTimestamp,
+	}, nil
+}
+
+// seek moves playback to the key frame preceding t.
+func (r *replayer) seek(ctx context.Context, t time.Time) {
+	r.send(ctx, replayCommand{event: "seek", at: t})
+}
+
+// live moves playback to the live edge of the buffer.
+func (r *replayer) live(ctx context.Context) {
+	r.send(ctx, replayCommand{event: "live"})
+}
+
+func (r *replayer) pause(ctx context.Context) {
+	r.send(ctx, replayCommand{event: "pause"})
+}
+
+func (r *replayer) play(ctx context.Context) {
+	r.send(ctx, replayCommand{event: "play"})
+}
+
+func (r *replayer) send(ctx context.Context, cmd replayCommand) {
+	select {
+	case r.commands <- cmd:
+	case <-ctx.Done():
+	}
+}
+
+func (r *replayer) handleCommand(cmd replayCommand) {
+	switch cmd.event {
+	case "seek":
+		pos, ok := r.buffer.KeyFrameBefore(cmd.at)
+		if !ok {
+			log.Println("replay: no key frame in buffer")
+			return
+		}
+		r.pos = pos
+		r.paused = false
+		r.catchUp = false
+		r.resync = true
+
+	case "live":
+		pos, ok := r.buffer.LatestKeyFrame()
+		if !ok {
+			log.Println("replay: no key frame in buffer")
+			return
+		}
+		r.pos = pos
+		r.paused = false
+		r.catchUp = true
+		r.resync = true
+
+	case "pause":
+		r.paused = true
+
+	case "play":
+		if r.paused {
+			r.paused = false
+			r.resync = true
+		}
+	}
+}
+
+func (r *replayer) run(ctx context.Context) {
+	for {
+		if r.paused {
+			select {
+			case cmd := <-r.commands:
+				r.handleCommand(cmd)
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		e, next, wait := r.buffer.Read(r.pos)
+		if e == nil {
+			// reached the live edge: restart the clock from the next entry
+			r.catchUp = false
+			select {
+			case <-wait:
+				r.restartClock = true
+			case cmd := <-r.commands:
+				r.handleCommand(cmd)
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if r.resync {
+			r.resync = false
+			r.restartClock = true
+			r.tsOffset = r.lastTS + discontinuityGap - ptsToTimestamp(e.PTS)
+		}
+		if r.restartClock {
+			r.restartClock = false
+			r.startWall = time.Now()
+			r.startPTS = e.PTS
+		}
+
+		if !r.catchUp {
+			timer := time.NewTimer(time.Until(r.startWall.Add(e.PTS - r.startPTS)))
+			select {
+			case <-timer.C:
+			case cmd := <-r.commands:
+				timer.Stop()
+				r.handleCommand(cmd)
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		r.pos = next
+		if err := r.write(e); err != nil {
+			log.Printf("replay: %s", err.Error())
+		}
+	}
+}
+
+func (r *replayer) write(e *dvr.Entry) error {
+	packets, err := r.encoder.Encode(e.AU)
+	if err != nil {
+		return err
+	}
+
+	ts := ptsToTimestamp(e.PTS) + r.tsOffset
+	for _, pkt := range packets {
+		pkt.Timestamp = ts
+		if err := r.track.WriteRTP(pkt); err != nil {
+			return err
+		}
+	}
+	r.lastTS = ts
+	return nil
+}
+
+func ptsToTimestamp(pts time.Duration) uint32 {
+	// split the multiplication to avoid an int64 overflow
+	secs := pts / time.Second
+	dec := pts % time.Second
+	return uint32(secs*videoClockRate + dec*videoClockRate/time.Second)
+}
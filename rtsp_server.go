@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/auth"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/headers"
+	"github.com/pion/rtp"
+)
+
+const rtspRealm = "rtspwebrtcbridge"
+
+// rtspServer republishes the ingested streams to RTSP readers,
+// so that any number of readers share a single connection to the source.
+// It also accepts publishers on the streams which allow them.
+type rtspServer struct {
+	server *gortsplib.Server
+	nonce  string
+
+	mutex      sync.RWMutex
+	streams    map[string]rtspPath
+	publishers map[string]*gortsplib.ServerSession
+}
+
+// rtspPath is a stream available to readers, with the live stream which feeds it.
+type rtspPath struct {
+	owner  *liveStream
+	stream *gortsplib.ServerStream
+}
+
+func newRTSPServer(address string, udpRTPAddress string, udpRTCPAddress string) (*rtspServer, error) {
+	nonce, err := auth.GenerateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &rtspServer{
+		nonce:      nonce,
+		streams:    make(map[string]rtspPath),
+		publishers: make(map[string]*gortsplib.ServerSession),
+	}
+
+	s.server = &gortsplib.Server{
+		Handler:        s,
+		RTSPAddress:    address,
+		UDPRTPAddress:  udpRTPAddress,
+		UDPRTCPAddress: udpRTCPAddress,
+	}
+
+	if err := s.server.Start(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// addStream makes a stream available to readers under the name of owner.
+// It returns nil once owner is closed, since a stream which replaced it may own the path by then.
+func (s *rtspServer) addStream(owner *liveStream, desc *description.Session) *gortsplib.ServerStream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if owner.ctx.Err() != nil {
+		return nil
+	}
+
+	if old, ok := s.streams[owner.name]; ok {
+		old.stream.Close()
+	}
+
+	stream := gortsplib.NewServerStream(s.server, desc)
+	s.streams[owner.name] = rtspPath{owner: owner, stream: stream}
+	return stream
+}
+
+// removeStream disconnects the readers of the name of owner, unless another stream owns it.
+func (s *rtspServer) removeStream(owner *liveStream) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if path, ok := s.streams[owner.name]; ok && path.owner == owner {
+		path.stream.Close()
+		delete(s.streams, owner.name)
+	}
+}
+
+func (s *rtspServer) findStream(path string) (*base.Response, *gortsplib.ServerStream, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	p, ok := s.streams[strings.TrimPrefix(path, "/")]
+	if !ok {
+		return &base.Response{
+			StatusCode: base.StatusNotFound,
+		}, nil, nil
+	}
+
+	return &base.Response{
+		StatusCode: base.StatusOK,
+	}, p.stream, nil
+}
+
+// OnDescribe implements gortsplib.ServerHandlerOnDescribe.
+func (s *rtspServer) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	return s.findStream(ctx.Path)
+}
+
+// OnSetup implements gortsplib.ServerHandlerOnSetup.
+func (s *rtspServer) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	// publishers don't need a stream
+	if ctx.Session.State() == gortsplib.ServerSessionStatePreRecord {
+		return &base.Response{
+			StatusCode: base.StatusOK,
+		}, nil, nil
+	}
+
+	return s.findStream(ctx.Path)
+}
+
+// OnAnnounce implements gortsplib.ServerHandlerOnAnnounce.
+func (s *rtspServer) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*base.Response, error) {
+	path := strings.TrimPrefix(ctx.Path, "/")
+
+	stream := findStream(path)
+	if stream == nil || stream.publish == nil {
+		return &base.Response{
+			StatusCode: base.StatusNotFound,
+		}, nil
+	}
+
+	pp := stream.publish
+	if pp.user != "" || pp.pass != "" {
+		err := validatePublisher(ctx.Request, pp.user, pp.pass, s.nonce)
+		if err != nil {
+			if _, ok := ctx.Request.Header["Authorization"]; ok {
+				log.Printf("rtsp: %s failed to authenticate on '%s': %s", ctx.Conn.NetConn().RemoteAddr(), path, err.Error())
+			}
+			return &base.Response{
+				StatusCode: base.StatusUnauthorized,
+				Header: base.Header{
+					"WWW-Authenticate": auth.GenerateWWWAuthenticate(nil, rtspRealm, s.nonce),
+				},
+			}, nil
+		}
+	}
+
+	if _, _, err := stream.findFormat(ctx.Description); err != nil {
+		return &base.Response{
+			StatusCode: base.StatusBadRequest,
+		}, err
+	}
+
+	// the newest publisher replaces the previous one, whether it uses RTSP or WHIP
+	s.mutex.Lock()
+	s.publishers[path] = ctx.Session
+	s.mutex.Unlock()
+	stream.setPublisher(ctx.Session.Close)
+
+	return &base.Response{
+		StatusCode: base.StatusOK,
+	}, nil
+}
+
+// validatePublisher checks the basic or digest credentials of a publisher like auth.Validate,
+// comparing them in constant time.
+func validatePublisher(req *base.Request, user string, pass string, nonce string) error {
+	var a headers.Authorization
+	if err := a.Unmarshal(req.Header["Authorization"]); err != nil {
+		return err
+	}
+
+	switch a.Method {
+	case headers.AuthDigestSHA256, headers.AuthDigestMD5:
+		if a.Nonce != nonce || a.Realm != rtspRealm || a.URI != req.URL.String() {
+			return errors.New("wrong nonce, realm or URL")
+		}
+
+		response := digestHex(a.Method, digestHex(a.Method, user+":"+rtspRealm+":"+pass)+
+			":"+nonce+":"+digestHex(a.Method, string(req.Method)+":"+a.URI))
+		if subtle.ConstantTimeCompare([]byte(a.Username), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(a.Response), []byte(response)) != 1 {
+			return errors.New("authentication failed")
+		}
+
+	case headers.AuthBasic:
+		if subtle.ConstantTimeCompare([]byte(a.BasicUser), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(a.BasicPass), []byte(pass)) != 1 {
+			return errors.New("authentication failed")
+		}
+
+	default:
+		return errors.New("no supported authentication methods found")
+	}
+
+	return nil
+}
+
+func digestHex(method headers.AuthMethod, in string) string {
+	if method == headers.AuthDigestSHA256 {
+		h := sha256.Sum256([]byte(in))
+		return hex.EncodeToString(h[:])
+	}
+	h := md5.Sum([]byte(in))
+	return hex.EncodeToString(h[:])
+}
+
+// OnRecord implements gortsplib.ServerHandlerOnRecord.
+func (s *rtspServer) OnRecord(ctx *gortsplib.ServerHandlerOnRecordCtx) (*base.Response, error) {
+	path := strings.TrimPrefix(ctx.Path, "/")
+
+	stream := findStream(path)
+	if stream == nil {
+		return &base.Response{
+			StatusCode: base.StatusNotFound,
+		}, nil
+	}
+
+	medi, forma, err := stream.findFormat(ctx.Session.AnnouncedDescription())
+	if err != nil {
+		return &base.Response{
+			StatusCode: base.StatusBadRequest,
+		}, err
+	}
+
+	var audioFormat *format.Opus
+	audioMedia := ctx.Session.AnnouncedDescription().FindFormat(&audioFormat)
+
+	in, err := stream.newIngest(forma, audioFormat)
+	if err != nil {
+		return &base.Response{
+			StatusCode: base.StatusBadRequest,
+		}, err
+	}
+
+	ctx.Session.OnPacketRTP(medi, forma, func(pkt *rtp.Packet) {
+		pts, ok := ctx.Session.PacketPTS(medi, pkt)
+		if !ok {
+			return
+		}
+		if err := in.processRTPPacket(pkt, pts); err != nil {
+			log.Printf("rtsp: publisher of '%s': %s", path, err.Error())
+			ctx.Session.Close()
+		}
+	})
+
+	if audioMedia != nil {
+		ctx.Session.OnPacketRTP(audioMedia, audioFormat, func(pkt *rtp.Packet) {
+			pts, ok := ctx.Session.PacketPTS(audioMedia, pkt)
+			if !ok {
+				return
+			}
+			in.processAudioRTPPacket(pkt, pts)
+		})
+	}
+
+	log.Printf("rtsp: %s is publishing to '%s'", ctx.Conn.NetConn().RemoteAddr(), path)
+	return &base.Response{
+		StatusCode: base.StatusOK,
+	}, nil
+}
+
+// OnSessionClose implements gortsplib.ServerHandlerOnSessionClose.
+func (s *rtspServer) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for path, publisher := range s.publishers {
+		if publisher == ctx.Session {
+			log.Printf("rtsp: publisher of '%s' disconnected", path)
+			delete(s.publishers, path)
+		}
+	}
+}
+
+// OnPlay implements gortsplib.ServerHandlerOnPlay.
+func (s *rtspServer) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	log.Printf("rtsp: %s is reading '%s'", ctx.Conn.NetConn().RemoteAddr(), strings.TrimPrefix(ctx.Path, "/"))
+	return &base.Response{
+		StatusCode: base.StatusOK,
+	}, nil
+}
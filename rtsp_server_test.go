@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/auth"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/headers"
+)
+
+func TestValidatePublisher(t *testing.T) {
+	const nonce = "0123456789abcdef"
+
+	for _, ca := range []struct {
+		name    string
+		methods []headers.AuthMethod
+		nonce   string
+		user    string
+		pass    string
+		ok      bool
+	}{
+		{"digest SHA-256", []headers.AuthMethod{headers.AuthDigestSHA256}, nonce, "user", "pass", true},
+		{"digest MD5", []headers.AuthMethod{headers.AuthDigestMD5}, nonce, "user", "pass", true},
+		{"basic", []headers.AuthMethod{headers.AuthBasic}, nonce, "user", "pass", true},
+		{"digest with a wrong pass", []headers.AuthMethod{headers.AuthDigestSHA256}, nonce, "user", "pas", false},
+		{"digest with a wrong user", []headers.AuthMethod{headers.AuthDigestMD5}, nonce, "admin", "pass", false},
+		{"digest with another nonce", []headers.AuthMethod{headers.AuthDigestSHA256}, "fedcba9876543210", "user", "pass", false},
+		{"basic with a wrong pass", []headers.AuthMethod{headers.AuthBasic}, nonce, "user", "pass2", false},
+		{"basic with a wrong user", []headers.AuthMethod{headers.AuthBasic}, nonce, "use", "pass", false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			req := &base.Request{
+				Method: base.Announce,
+				URL:    mustParseRTSPURL(t, "rtsp://localhost:8555/cam1"),
+				Header: base.Header{},
+			}
+
+			sender, err := auth.NewSender(auth.GenerateWWWAuthenticate(ca.methods, rtspRealm, ca.nonce), ca.user, ca.pass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sender.AddAuthorization(req)
+
+			err = validatePublisher(req, "user", "pass", nonce)
+			if (err == nil) != ca.ok {
+				t.Errorf("expected %v, got %v", ca.ok, err)
+			}
+		})
+	}
+}
+
+func TestValidatePublisherWithoutCredentials(t *testing.T) {
+	req := &base.Request{
+		Method: base.Announce,
+		URL:    mustParseRTSPURL(t, "rtsp://localhost:8555/cam1"),
+		Header: base.Header{},
+	}
+	if err := validatePublisher(req, "user", "pass", "0123456789abcdef"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func mustParseRTSPURL(t *testing.T, s string) *base.URL {
+	u, err := base.ParseURL(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
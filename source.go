@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/liberrors"
+)
+
+const (
+	// pause between the attempts to pull a source
+	sourceRetryPause = 5 * time.Second
+
+	// how often the primary URL is checked while a backup is in use
+	primaryProbeInterval = 30 * time.Second
+
+	// how long a source can go without sending packets or access units
+	defaultStallTimeout = 10 * time.Second
+	minStallTimeout     = time.Second
+)
+
+var transportLookup = map[string]*gortsplib.Transport{
+	"auto":      nil,
+	"udp":       transportPtr(gortsplib.TransportUDP),
+	"multicast": transportPtr(gortsplib.TransportUDPMulticast),
+	"tcp":       transportPtr(gortsplib.TransportTCP),
+}
+
+func transportPtr(t gortsplib.Transport) *gortsplib.Transport {
+	return &t
+}
+
+// rtspSourceConf is the configuration of a stream pulled from a RTSP server.
+type rtspSourceConf struct {
+	// the primary URL followed by the backups, in order of preference
+	urls []string
+
+	// one of the keys of transportLookup
+	transport     string
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	anyPortEnable bool
+
+	// the session is closed when no packets or no access units are received for this long
+	stallTimeout time.Duration
+
+	// verification of rtsps:// servers, at most one of them can be set
+	caFile      string
+	fingerprint string
+	insecure    bool
+
+	// pull only while there are viewers, until onDemandCloseAfter after the last one left
+	onDemand           bool
+	onDemandCloseAfter time.Duration
+}
+
+// rtspSource is a stream pulled from a RTSP server.
+type rtspSource struct {
+	rtspSourceConf
+	tlsConfig *tls.Config
+
+	bytesReceived uint64
+	packetsLost   atomic.Uint64
+
+	failovers atomic.Uint64
+
+	mutex sync.Mutex
+	// transport in use, the automatic mode starts with UDP and may switch to TCP
+	currentTransport string
+	// index of the URL in use
+	active int
+}
+
+func newRTSPSource(conf rtspSourceConf) (*rtspSource, error) {
+	if _, ok := transportLookup[conf.transport]; !ok {
+		return nil, fmt.Errorf("invalid transport '%s', expected auto, udp, multicast or tcp", conf.transport)
+	}
+
+	if conf.readTimeout < 0 || conf.writeTimeout < 0 || conf.stallTimeout < 0 {
+		return nil, errors.New("timeouts must not be negative")
+	}
+	if conf.stallTimeout == 0 {
+		conf.stallTimeout = defaultStallTimeout
+	}
+	if conf.stallTimeout < minStallTimeout {
+		return nil, fmt.Errorf("stall timeout must be at least %s", minStallTimeout)
+	}
+
+	tlsConfig, err := conf.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rtspSource{
+		rtspSourceConf: conf,
+		tlsConfig:      tlsConfig,
+	}, nil
+}
+
+// tlsConfig returns the TLS configuration for rtsps:// servers, nil for the system defaults.
+func (conf rtspSourceConf) tlsConfig() (*tls.Config, error) {
+	n := 0
+	for _, set := range []bool{conf.caFile != "", conf.fingerprint != "", conf.insecure} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, errors.New("a CA file, a fingerprint and insecure mode can't be combined")
+	}
+
+	switch {
+	case conf.caFile != "":
+		pem, err := os.ReadFile(conf.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file '%s'", conf.caFile)
+		}
+		return &tls.Config{RootCAs: pool}, nil
+
+	case conf.fingerprint != "":
+		// accept colons and uppercase, as printed by openssl
+		expected := strings.ToLower(strings.ReplaceAll(conf.fingerprint, ":", ""))
+		if b, err := hex.DecodeString(expected); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid fingerprint '%s', expected the hex encoded SHA256 of the certificate", conf.fingerprint)
+		}
+
+		return &tls.Config{
+			// the chain is replaced by the comparison of the leaf certificate with the fingerprint
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				h := sha256.Sum256(cs.PeerCertificates[0].Raw)
+				if fingerprint := hex.EncodeToString(h[:]); fingerprint != expected {
+					return fingerprintError{fingerprint: fingerprint}
+				}
+				return nil
+			},
+		}, nil
+
+	case conf.insecure:
+		return &tls.Config{InsecureSkipVerify: true}, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+type fingerprintError struct {
+	fingerprint string
+}
+
+func (e fingerprintError) Error() string {
+	return fmt.Sprintf("server fingerprint %s doesn't match the configured one", e.fingerprint)
+}
+
+// describeError explains the failures of the TLS handshake,
+// which otherwise surface as generic connection errors.
+func describeError(rawURL string, err error) error {
+	var certErr *tls.CertificateVerificationError
+	var fpErr fingerprintError
+
+	switch {
+	case errors.As(err, &certErr):
+		return fmt.Errorf("TLS verification of '%s' failed, set a CA file, a fingerprint or insecure mode: %w", redactURL(rawURL), err)
+	case errors.As(err, &fpErr):
+		return fmt.Errorf("TLS verification of '%s' failed: %w", redactURL(rawURL), err)
+	default:
+		return fmt.Errorf("source '%s': %w", redactURL(rawURL), err)
+	}
+}
+
+func (src *rtspSource) activeURL() (int, string) {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	return src.active, src.urls[src.active]
+}
+
+func (src *rtspSource) setActive(i int) {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	src.active = i
+}
+
+// run pulls the source into s until s is removed.
+// After a failure the next URL is tried immediately, and once all of them have failed
+// the primary one is tried again after a pause.
+// While a backup is in use, the primary URL is probed and pulled again as soon as it answers.
+func (src *rtspSource) run(s *liveStream) {
+	for {
+		if src.onDemand && !s.waitViewers() {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		idle := make(chan struct{})
+		if src.onDemand {
+			go func() {
+				if s.waitIdle(ctx, src.onDemandCloseAfter) {
+					close(idle)
+					cancel()
+				}
+			}()
+		}
+
+		active, rawURL := src.activeURL()
+		failback := make(chan struct{})
+		if active != 0 {
+			go func() {
+				if src.probePrimary(ctx, s) {
+					close(failback)
+					cancel()
+				}
+			}()
+		}
+
+		err := src.pull(ctx, s, rawURL)
+		cancel()
+
+		select {
+		case <-s.ctx.Done():
+			return
+
+		case <-idle:
+			log.Printf("stream '%s': no viewers for %s, closing the source", s.name, src.onDemandCloseAfter)
+			if rtspSrv != nil {
+				rtspSrv.removeStream(s)
+			}
+			continue
+
+		case <-failback:
+			log.Printf("stream '%s': failing back to '%s'", s.name, redactURL(src.urls[0]))
+			src.setActive(0)
+			continue
+
+		default:
+		}
+
+		if err != nil {
+			log.Println(describeError(rawURL, err))
+		}
+		s.setStalled(true)
+
+		if len(src.urls) > 1 {
+			next := (active + 1) % len(src.urls)
+			src.setActive(next)
+			if next != 0 {
+				src.failovers.Add(1)
+				log.Printf("stream '%s': failing over to '%s'", s.name, redactURL(src.urls[next]))
+				continue
+			}
+			log.Printf("stream '%s': all the URLs failed, retrying '%s'", s.name, redactURL(src.urls[0]))
+		}
+
+		select {
+		case <-time.After(sourceRetryPause):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// probePrimary checks the primary URL periodically until it offers the format of s,
+// and returns false if ctx is canceled first.
+func (src *rtspSource) probePrimary(ctx context.Context, s *liveStream) bool {
+	t := time.NewTicker(primaryProbeInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return false
+		}
+
+		if err := src.probe(s, src.urls[0]); err == nil {
+			return ctx.Err() == nil
+		}
+	}
+}
+
+// probe describes rawURL without reading it.
+// It doesn't go through client, which would count the session in the statistics of the source.
+func (src *rtspSource) probe(s *liveStream, rawURL string) error {
+	u, err := base.ParseURL(rawURL)
+	if err != nil {
+		return err
+	}
+
+	c := &gortsplib.Client{
+		TLSConfig:    src.tlsConfig,
+		ReadTimeout:  src.readTimeout,
+		WriteTimeout: src.writeTimeout,
+	}
+	if err := c.Start(u.Scheme, u.Host); err != nil {
+		return err
+	}
+	defer c.Close()
+
+	desc, _, err := c.Describe(u)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.findFormat(desc)
+	return err
+}
+
+// pull reads rawURL into s until a failure, a stall or until ctx is canceled.
+func (src *rtspSource) pull(ctx context.Context, s *liveStream, rawURL string) error {
+	u, err := base.ParseURL(rawURL)
+	if err != nil {
+		return err
+	}
+
+	c := src.client(u.Scheme, rawURL)
+
+	// connect to the server
+	if err := c.Start(u.Scheme, u.Host); err != nil {
+		return err
+	}
+	defer c.Close()
+
+	now := time.Now().UnixNano()
+	s.lastPacket.Store(now)
+	s.lastAU.Store(now)
+
+	// interrupt the session when the stream is removed or when the server keeps the session open
+	// without sending anything usable
+	var stallReason atomic.Value
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(src.stallTimeout / 4)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				if reason := s.stallReason(src.stallTimeout); reason != "" {
+					stallReason.Store(reason)
+					c.Close()
+					return
+				}
+			case <-ctx.Done():
+				c.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = stream(c, u, s)
+	if reason, ok := stallReason.Load().(string); ok {
+		return fmt.Errorf("stalled, %s for %s", reason, src.stallTimeout)
+	}
+	return err
+}
+
+// client returns a client configured for the source,
+// which updates the counters of the source.
+func (src *rtspSource) client(scheme string, rawURL string) *gortsplib.Client {
+	current := src.transport
+	if current == "auto" {
+		if scheme == "rtsps" {
+			current = "tcp"
+		} else {
+			current = "udp"
+		}
+	}
+	src.setCurrentTransport(current)
+
+	return &gortsplib.Client{
+		TLSConfig:     src.tlsConfig,
+		Transport:     transportLookup[src.transport],
+		ReadTimeout:   src.readTimeout,
+		WriteTimeout:  src.writeTimeout,
+		AnyPortEnable: src.anyPortEnable,
+		BytesReceived: &src.bytesReceived,
+		OnTransportSwitch: func(err error) {
+			log.Printf("rtsp source '%s': %s", redactURL(rawURL), err.Error())
+			src.setCurrentTransport("tcp")
+		},
+		OnPacketLost: func(err error) {
+			var lost liberrors.ErrClientRTPPacketsLost
+			if errors.As(err, &lost) {
+				src.packetsLost.Add(uint64(lost.Lost))
+			}
+		},
+	}
+}
+
+func (src *rtspSource) setCurrentTransport(t string) {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	src.currentTransport = t
+}
+
+type sourceStats struct {
+	URL                 string `json:"url"`
+	Transport           string `json:"transport"`
+	ConfiguredTransport string `json:"configuredTransport"`
+	ReadTimeout         string `json:"readTimeout"`
+	WriteTimeout        string `json:"writeTimeout"`
+	StallTimeout        string `json:"stallTimeout"`
+	AnyPortEnable       bool   `json:"anyPortEnable"`
+	BytesReceived       uint64 `json:"bytesReceived"`
+	PacketsLost         uint64 `json:"packetsLost"`
+	Failovers           uint64 `json:"failovers"`
+}
+
+func (src *rtspSource) stats() *sourceStats {
+	src.mutex.Lock()
+	current := src.currentTransport
+	active := src.urls[src.active]
+	src.mutex.Unlock()
+
+	return &sourceStats{
+		URL:                 redactURL(active),
+		Transport:           current,
+		ConfiguredTransport: src.transport,
+		ReadTimeout:         timeoutString(src.readTimeout),
+		WriteTimeout:        timeoutString(src.writeTimeout),
+		StallTimeout:        src.stallTimeout.String(),
+		AnyPortEnable:       src.anyPortEnable,
+		BytesReceived:       atomic.LoadUint64(&src.bytesReceived),
+		PacketsLost:         src.packetsLost.Load(),
+		Failovers:           src.failovers.Load(),
+	}
+}
+
+// redactURL hides the password of rawURL.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// timeoutString formats a timeout, where zero stands for the default of the client.
+func timeoutString(d time.Duration) string {
+	if d == 0 {
+		return "default"
+	}
+	return d.String()
+}
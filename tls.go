@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate of certFile and keyFile,
+// loading it again when either file changes on disk.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	modTimes, err := r.readModTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cert = &cert
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *certReloader) readModTimes() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+// watch reloads the certificate when the files change.
+// A certificate which can't be loaded, for instance while the files are being replaced,
+// is logged and the previous one is kept until the next attempt.
+func (r *certReloader) watch() {
+	for range time.Tick(certCheckInterval) {
+		modTimes, err := r.readModTimes()
+		if err != nil {
+			log.Printf("tls: %s", err.Error())
+			continue
+		}
+
+		r.mutex.RLock()
+		changed := modTimes != r.modTimes
+		r.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := r.load(); err != nil {
+			log.Printf("tls: unable to reload the certificate, keeping the previous one: %s", err.Error())
+			continue
+		}
+		log.Printf("tls: certificate reloaded from '%s'", r.certFile)
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
@@ -44,6 +44,18 @@ type H265 struct {
 	AU [][]byte
 }
 
+// VP8 is a VP8 data unit.
+type VP8 struct {
+	Base
+	Frame []byte
+}
+
+// Opus is a Opus data unit.
+type Opus struct {
+	Base
+	Packets [][]byte
+}
+
 // Base contains fields shared across all units.
 type Base struct {
 	RTPPackets []*rtp.Packet
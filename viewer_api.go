@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/flexfec"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	viewerVideoPayloadType = 96
+	// RTX payload types are those of the video codecs plus this offset
+	viewerRTXPayloadOffset = 10
+	viewerAudioPayloadType = 111
+	viewerFECPayloadType   = 115
+
+	// initial bandwidth estimate of the viewers in bits per second, high enough not to start with
+	// dropped frames, the congestion controller lowers it to what the viewer actually receives
+	initialBandwidthEstimate = 20_000_000
+)
+
+// lossRecovery protects the video sent to the viewers against packet loss.
+var lossRecovery lossRecoveryConf
+
+// newViewerAPI returns an API for a single viewer offering the codec of the stream and Opus, using the ICE settings,
+// and a channel receiving the congestion controller of its peer connection.
+// The controller only estimates the bandwidth, packets are sent without pacing.
+// Lost packets are retransmitted, on a RTX stream when enabled, and protected by FlexFEC when enabled.
+func newViewerAPI(mimeType string, counter *recoveryCounter) (*webrtc.API, <-chan cc.BandwidthEstimator, error) {
+	m := &webrtc.MediaEngine{}
+
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}}
+	videoCodecs, err := videoCodecs(mimeType, viewerVideoPayloadType, feedback)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, codec := range videoCodecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, nil, err
+		}
+
+		if lossRecovery.RTX {
+			err := m.RegisterCodec(webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:    webrtc.MimeTypeRTX,
+					ClockRate:   videoClockRate,
+					SDPFmtpLine: "apt=" + strconv.Itoa(int(codec.PayloadType)),
+				},
+				PayloadType: codec.PayloadType + viewerRTXPayloadOffset,
+			}, webrtc.RTPCodecTypeVideo)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if err := m.RegisterCodec(opusCodec(viewerAudioPayloadType), webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, nil, err
+	}
+
+	// the counter sees the packets as they are sent, after FEC and retransmissions
+	i := &interceptor.Registry{}
+	i.Add(counter)
+
+	if lossRecovery.FECPackets != 0 {
+		err := webrtc.ConfigureFlexFEC03(viewerFECPayloadType, m, i,
+			flexfec.NumMediaPackets(uint32(lossRecovery.FECGroup)),
+			flexfec.NumFECPackets(uint32(lossRecovery.FECPackets)))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, nil, err
+	}
+
+	// the pacer of the congestion controller only knows the video and audio streams,
+	// retransmissions and FEC packets are written below it
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBandwidthEstimate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	estimators := make(chan cc.BandwidthEstimator, 1)
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		estimators <- estimator
+	})
+	i.Add(congestionController)
+
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, nil, err
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
+	return api, estimators, nil
+}
+
+// recoveryCounter counts the packets sent to a viewer to recover the lost ones.
+// It is its own factory, as it is created for a single peer connection.
+type recoveryCounter struct {
+	interceptor.NoOp
+
+	retransmitted atomic.Uint64
+	fec           atomic.Uint64
+}
+
+func (c *recoveryCounter) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return c, nil
+}
+
+func (c *recoveryCounter) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		switch {
+		case header.SSRC == info.SSRC:
+		case header.SSRC == info.SSRCRetransmission:
+			c.retransmitted.Add(1)
+		case header.SSRC == info.SSRCForwardErrorCorrection:
+			c.fec.Add(1)
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/rtptime"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/intervalpli"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	whipVideoPayloadType = 96
+	whipAudioPayloadType = 111
+
+	// how often publishers are asked for a key frame,
+	// which bounds the time viewers and rewinds wait for one
+	whipKeyFrameInterval = 2 * time.Second
+
+	// offers are a few KiB of SDP
+	maxWHIPOfferSize = 64 << 10
+)
+
+// whipSession is the connection of a WHIP publisher to a stream.
+type whipSession struct {
+	stream string
+	pc     *webrtc.PeerConnection
+}
+
+var (
+	whipSessionsMutex sync.Mutex
+	whipSessions      = map[string]*whipSession{}
+)
+
+// serveWHIP handles WHIP publishers, POST /whip/{stream} creates a session
+// and DELETE /whip/{stream}/{session} terminates it.
+func serveWHIP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/whip/"), "/")
+
+	s := findStream(parts[0])
+	if s == nil || s.publish == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if pp := s.publish; pp.user != "" || pp.pass != "" {
+		user, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(pp.user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(pp.pass)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+rtspRealm+`"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		serveWHIPOffer(w, r, s)
+
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		// publishers can only terminate the sessions of the stream they are authorized on
+		whipSessionsMutex.Lock()
+		sess, ok := whipSessions[parts[1]]
+		if ok && sess.stream == s.name {
+			delete(whipSessions, parts[1])
+		}
+		whipSessionsMutex.Unlock()
+
+		if !ok || sess.stream != s.name {
+			http.NotFound(w, r)
+			return
+		}
+		sess.pc.Close() //nolint:errcheck
+
+	case len(parts) == 1, len(parts) == 2:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func serveWHIPOffer(w http.ResponseWriter, r *http.Request, s *liveStream) {
+	if r.Header.Get("Content-Type") != "application/sdp" {
+		http.Error(w, "expected application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offer, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWHIPOfferSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "offer too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "unable to read offer", http.StatusBadRequest)
+		return
+	}
+
+	videoFormat, err := whipVideoFormat(s.mimeType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audioFormat := &format.Opus{PayloadTyp: whipAudioPayloadType, IsStereo: true}
+
+	api, err := newWHIPAPI(s.mimeType)
+	if err != nil {
+		log.Printf("whip: %s", err.Error())
+		http.Error(w, "unable to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	pc, err := api.NewPeerConnection(peerConnectionConfig)
+	if err != nil {
+		log.Printf("whip: %s", err.Error())
+		http.Error(w, "unable to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+		pc.Close() //nolint:errcheck
+		http.Error(w, "invalid offer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hasVideo, hasAudio := false, false
+	for _, t := range pc.GetTransceivers() {
+		switch t.Kind() {
+		case webrtc.RTPCodecTypeVideo:
+			hasVideo = true
+		case webrtc.RTPCodecTypeAudio:
+			hasAudio = true
+		}
+	}
+	if !hasVideo {
+		pc.Close() //nolint:errcheck
+		http.Error(w, "offer doesn't contain a video track", http.StatusBadRequest)
+		return
+	}
+	if !hasAudio {
+		audioFormat = nil
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close() //nolint:errcheck
+		http.Error(w, "unable to answer offer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close() //nolint:errcheck
+		http.Error(w, "unable to answer offer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	<-gatherComplete
+
+	in, err := s.newIngest(videoFormat, audioFormat)
+	if err != nil {
+		pc.Close() //nolint:errcheck
+		log.Printf("whip: %s", err.Error())
+		http.Error(w, "unable to create ingest", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := newWHIPSessionID()
+	if err != nil {
+		pc.Close() //nolint:errcheck
+		http.Error(w, "unable to create session", http.StatusInternalServerError)
+		return
+	}
+
+	whipSessionsMutex.Lock()
+	whipSessions[id] = &whipSession{stream: s.name, pc: pc}
+	whipSessionsMutex.Unlock()
+
+	remoteAddr := r.RemoteAddr
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			whipSessionsMutex.Lock()
+			delete(whipSessions, id)
+			whipSessionsMutex.Unlock()
+			pc.Close() //nolint:errcheck
+			log.Printf("whip: publisher %s of '%s' disconnected", remoteAddr, s.name)
+		}
+	})
+
+	// video and audio share a decoder so that their timestamps stay in sync
+	timeDecoder := rtptime.NewGlobalDecoder()
+	var timeDecoderMutex sync.Mutex
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		forma := videoFormat
+		process := in.processRTPPacket
+		if track.Kind() == webrtc.RTPCodecTypeAudio {
+			if audioFormat == nil {
+				return
+			}
+			forma = audioFormat
+			process = func(pkt *rtp.Packet, pts time.Duration) error {
+				in.processAudioRTPPacket(pkt, pts)
+				return nil
+			}
+		}
+
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+
+			// payload types are negotiated by the publisher,
+			// readers expect the ones of the formats
+			pkt.PayloadType = uint8(forma.PayloadType())
+
+			timeDecoderMutex.Lock()
+			pts, ok := timeDecoder.Decode(forma, pkt)
+			timeDecoderMutex.Unlock()
+			if !ok {
+				continue
+			}
+
+			if err := process(pkt, pts); err != nil {
+				log.Printf("whip: publisher %s of '%s': %s", remoteAddr, s.name, err.Error())
+				pc.Close() //nolint:errcheck
+				return
+			}
+		}
+	})
+
+	// the newest publisher replaces the previous one, whether it uses RTSP or WHIP
+	s.setPublisher(func() {
+		pc.Close() //nolint:errcheck
+	})
+	log.Printf("whip: %s is publishing to '%s'", r.RemoteAddr, s.name)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+s.name+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, pc.LocalDescription().SDP) //nolint:errcheck
+}
+
+// newWHIPAPI returns an API accepting only the codec of the stream and Opus.
+func newWHIPAPI(mimeType string) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+
+	videoCodecs, err := videoCodecs(mimeType, whipVideoPayloadType, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, codec := range videoCodecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.RegisterCodec(opusCodec(whipAudioPayloadType), webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+
+	pli, err := intervalpli.NewReceiverInterceptor(intervalpli.GeneratorInterval(whipKeyFrameInterval))
+	if err != nil {
+		return nil, err
+	}
+	i.Add(pli)
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine)), nil
+}
+
+// videoCodecs returns the variants of the codec of mimeType, numbered from payloadType.
+func videoCodecs(mimeType string, payloadType webrtc.PayloadType, feedback []webrtc.RTCPFeedback) ([]webrtc.RTPCodecParameters, error) {
+	switch mimeType {
+	case webrtc.MimeTypeH264:
+		var codecs []webrtc.RTPCodecParameters
+		for i, profile := range []string{"42001f", "42e01f", "4d001f", "640032"} {
+			codecs = append(codecs, webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:     webrtc.MimeTypeH264,
+					ClockRate:    videoClockRate,
+					SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+					RTCPFeedback: feedback,
+				},
+				PayloadType: payloadType + webrtc.PayloadType(i),
+			})
+		}
+		return codecs, nil
+
+	case webrtc.MimeTypeH265, webrtc.MimeTypeVP8:
+		return []webrtc.RTPCodecParameters{{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     mimeType,
+				ClockRate:    videoClockRate,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: payloadType,
+		}}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported mime type %s", mimeType)
+	}
+}
+
+func opusCodec(payloadType webrtc.PayloadType) webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: payloadType,
+	}
+}
+
+func whipVideoFormat(mimeType string) (format.Format, error) {
+	switch mimeType {
+	case webrtc.MimeTypeH264:
+		return &format.H264{PayloadTyp: whipVideoPayloadType, PacketizationMode: 1}, nil
+	case webrtc.MimeTypeH265:
+		return &format.H265{PayloadTyp: whipVideoPayloadType}, nil
+	case webrtc.MimeTypeVP8:
+		return &format.VP8{PayloadTyp: whipVideoPayloadType}, nil
+	default:
+		return nil, fmt.Errorf("unsupported mime type %s", mimeType)
+	}
+}
+
+func newWHIPSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}